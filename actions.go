@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"github.com/bwmarrin/discordgo" // for running the bot
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Action types.
+const (
+	// Send the response to the channel the command was triggered in. This is the default.
+	actionSend = "send"
+	// Send the response as a reply to the triggering message.
+	actionReply = "reply"
+	// Send the response to the author of the triggering message in a DM.
+	actionDM = "dm"
+	// Send the response to a different channel.
+	actionChannel = "channel"
+	// React to the triggering message with one or more emoji.
+	actionReact = "react"
+	// Send a sequence of messages, with delays and typing indicators between them.
+	actionSequence = "sequence"
+)
+
+// Discord's limits on messages.
+const (
+	maxMessageLength = 2000
+	maxMessageEmbeds = 10
+	maxMessageFiles  = 10
+)
+
+// How often the typing indicator has to be re-sent during long delays.
+// Discord shows it for about 10 seconds.
+const typingInterval = 8 * time.Second
+
+// ActionConfig is the config for something a command does with its response.
+// Commands that support actions run them in order; if none are set,
+// the response is sent to the triggering channel.
+type ActionConfig struct {
+	// Type of the action: "send", "reply", "dm", "channel", "react" or "sequence".
+	Type string `json:"type"`
+	// Channel ID to send to, for "channel" actions.
+	// "sequence" actions send here too, if set.
+	Channel string `json:"channel"`
+	// Emoji to react with, for "react" actions. Custom emoji are written as "name:id".
+	Emoji []string `json:"emoji"`
+	// Messages to send, in order, for "sequence" actions.
+	Messages []SequenceMessageConfig `json:"messages"`
+}
+
+// SequenceMessageConfig is a single message in a "sequence" action.
+type SequenceMessageConfig struct {
+	// Message content. This is a template, executed with the same data as the command's response.
+	Content string `json:"content"`
+	// How long to wait before sending the message, e.g. "1.5s".
+	Delay string `json:"delay"`
+	// Whether to show the typing indicator while waiting.
+	Typing bool `json:"typing"`
+}
+
+// responseAction does something with a command's response.
+type responseAction interface {
+	perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error
+}
+
+// responseActions is a list of actions, run in order.
+type responseActions []responseAction
+
+// newResponseActions creates actions from a list of action configs.
+// If the list is empty, the default "send" action is used.
+func newResponseActions(name string, configs []ActionConfig) (actions responseActions, err error) {
+	if len(configs) == 0 {
+		return responseActions{sendAction{}}, nil
+	}
+	for i, config := range configs {
+		var action responseAction
+		switch config.Type {
+		case "", actionSend:
+			action = sendAction{}
+		case actionReply:
+			action = replyAction{}
+		case actionDM:
+			action = dmAction{}
+		case actionChannel:
+			if len(config.Channel) == 0 {
+				return nil, errors.New("Channel actions must have a channel")
+			}
+			action = channelAction{channelID: config.Channel}
+		case actionReact:
+			if len(config.Emoji) == 0 {
+				return nil, errors.New("React actions must have at least one emoji")
+			}
+			action = reactAction{emoji: config.Emoji}
+		case actionSequence:
+			action, err = newSequenceAction(name+" action "+strconv.Itoa(i), config)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("Invalid action type " + config.Type)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// perform runs each action in order, stopping at the first error.
+func (a responseActions) perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error {
+	for _, action := range a {
+		err := action.perform(bot, evt, msg, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEmptyMessage checks if a message has nothing in it to send.
+func isEmptyMessage(msg *discordgo.MessageSend) bool {
+	return len(msg.Content) == 0 && len(msg.Embeds) == 0 && len(msg.Files) == 0
+}
+
+// sendMessage sends a message to a channel, skipping it if it's empty
+// (e.g. for commands that only react).
+func sendMessage(bot *discordgo.Session, channelID string, msg *discordgo.MessageSend) error {
+	if isEmptyMessage(msg) {
+		return nil
+	}
+	// rewind attachments, in case another action already sent them
+	for _, file := range msg.Files {
+		if seeker, ok := file.Reader.(io.Seeker); ok {
+			seeker.Seek(0, io.SeekStart)
+		}
+	}
+	_, err := bot.ChannelMessageSendComplex(channelID, msg)
+	return err
+}
+
+// renderMessage renders a message from a response template and an embed,
+// either of which can be nil.
+func renderMessage(tmpl *template.Template, embed *embedTemplate, data interface{}) (msg *discordgo.MessageSend, err error) {
+	msg = &discordgo.MessageSend{}
+	if tmpl != nil {
+		msg.Content, err = executeTemplate(tmpl, data)
+		if err != nil {
+			return nil, errors.New("could not execute template: " + err.Error())
+		}
+		msg.Content = strings.TrimSpace(msg.Content)
+	}
+	if embed != nil {
+		rendered, err := embed.render(data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Embeds = []*discordgo.MessageEmbed{rendered}
+	}
+	return msg, nil
+}
+
+// sendToChannels sends a message to several channels, stopping at the first that fails.
+func sendToChannels(bot *discordgo.Session, channels []string, msg *discordgo.MessageSend) error {
+	for _, channel := range channels {
+		err := sendMessage(bot, channel, msg)
+		if err != nil {
+			return errors.New("could not post to channel " + channel + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// announce renders a message and posts it to channels,
+// for commands that post on their own rather than in reply to messages.
+func announce(bot *discordgo.Session, channels []string, tmpl *template.Template, embed *embedTemplate, data interface{}) error {
+	msg, err := renderMessage(tmpl, embed, data)
+	if err != nil {
+		return err
+	}
+	return sendToChannels(bot, channels, msg)
+}
+
+type sendAction struct{}
+
+func (sendAction) perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error {
+	return sendMessage(bot, evt.Message.ChannelID, msg)
+}
+
+type replyAction struct{}
+
+func (replyAction) perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error {
+	// copy the message so other actions don't send a reply too
+	reply := *msg
+	reply.Reference = evt.Message.Reference()
+	return sendMessage(bot, evt.Message.ChannelID, &reply)
+}
+
+type dmAction struct{}
+
+func (dmAction) perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error {
+	channel, err := bot.UserChannelCreate(evt.Message.Author.ID)
+	if err != nil {
+		return errors.New("could not open DM: " + err.Error())
+	}
+	return sendMessage(bot, channel.ID, msg)
+}
+
+type channelAction struct {
+	channelID string
+}
+
+func (c channelAction) perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error {
+	return sendMessage(bot, c.channelID, msg)
+}
+
+type reactAction struct {
+	emoji []string
+}
+
+func (r reactAction) perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error {
+	for _, emoji := range r.emoji {
+		err := bot.MessageReactionAdd(evt.Message.ChannelID, evt.Message.ID, emoji)
+		if err != nil {
+			return errors.New("could not react with " + emoji + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// sequenceAction sends an ordered list of messages.
+type sequenceAction struct {
+	channelID string
+	messages  []sequenceMessage
+}
+
+type sequenceMessage struct {
+	content *template.Template
+	delay   time.Duration
+	typing  bool
+}
+
+func newSequenceAction(name string, config ActionConfig) (action sequenceAction, err error) {
+	if len(config.Messages) == 0 {
+		return action, errors.New("Sequence actions must have at least one message")
+	}
+	action.channelID = config.Channel
+	for i, message := range config.Messages {
+		var seqmsg sequenceMessage
+		seqmsg.typing = message.Typing
+		if len(message.Delay) > 0 {
+			seqmsg.delay, err = time.ParseDuration(message.Delay)
+			if err != nil {
+				return action, errors.New("Invalid sequence delay: " + err.Error())
+			}
+		}
+		seqmsg.content, err = newTemplate(name+" message "+strconv.Itoa(i), message.Content)
+		if err != nil {
+			return action, errors.New("Failed to compile sequence template: " + err.Error())
+		}
+		action.messages = append(action.messages, seqmsg)
+	}
+	return action, nil
+}
+
+func (s sequenceAction) perform(bot *discordgo.Session, evt *discordgo.MessageCreate, msg *discordgo.MessageSend, data interface{}) error {
+	channelID := s.channelID
+	if len(channelID) == 0 {
+		channelID = evt.Message.ChannelID
+	}
+	for _, message := range s.messages {
+		content, err := executeTemplate(message.content, data)
+		if err != nil {
+			return errors.New("could not execute sequence template: " + err.Error())
+		}
+		wait(bot, channelID, message.delay, message.typing)
+		_, err = bot.ChannelMessageSend(channelID, content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait sleeps for a delay, optionally showing the typing indicator in a channel.
+func wait(bot *discordgo.Session, channelID string, delay time.Duration, typing bool) {
+	for delay > 0 {
+		if typing {
+			// not being able to show typing isn't worth failing over
+			bot.ChannelTyping(channelID)
+		}
+		step := delay
+		if typing && step > typingInterval {
+			step = typingInterval
+		}
+		time.Sleep(step)
+		delay -= step
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bwmarrin/discordgo" // for running the bot
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Discord's upload limit for guilds without boosts, in bytes.
+const uploadLimit = 10 << 20
+
+// fileCacheSize is how much of the files attached to responses are kept in memory, in bytes.
+const fileCacheSize = 32 << 20
+
+// Files attached to responses are kept in memory, so they aren't reread on every trigger.
+// They're cached by their path, size and modification time, so they're reread if they change;
+// the least recently used ones (including old versions of changed files) are dropped once it's full.
+var fileCache = newMemoryCache(fileCacheSize)
+
+// readAttachment reads a file to attach, through the file cache,
+// making sure it's small enough to upload.
+func readAttachment(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errors.New(path + " is a directory")
+	}
+	if info.Size() > uploadLimit {
+		return nil, errors.New(path + " is too large to upload (" + strconv.FormatInt(info.Size(), 10) + " bytes)")
+	}
+	key := path + "\x00" + strconv.FormatInt(info.Size(), 10) + "\x00" + strconv.FormatInt(info.ModTime().UnixNano(), 10)
+	if data, ok := fileCache.Get(key); ok {
+		return data, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fileCache.Set(key, data)
+	return data, nil
+}
+
+// newAttachment creates a discordgo file to send from a local file.
+func newAttachment(path string) (*discordgo.File, error) {
+	data, err := readAttachment(path)
+	if err != nil {
+		return nil, err
+	}
+	return &discordgo.File{
+		Name:        filepath.Base(path),
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+		Reader:      bytes.NewReader(data),
+	}, nil
+}
+
+// randomFile picks a random regular file from a directory.
+func randomFile(dir string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return "", errors.New("no files in " + dir)
+	}
+	return files[rand.Intn(len(files))], nil
+}
+
+// attachmentSet is a list of files to attach to a response,
+// plus optionally a random file from a directory.
+type attachmentSet struct {
+	files     []string
+	directory string
+}
+
+// newAttachmentSet creates an attachmentSet, checking that the files can be sent.
+func newAttachmentSet(files []string, directory string) (set attachmentSet, err error) {
+	count := len(files)
+	if len(directory) > 0 {
+		count++
+	}
+	if count > maxMessageFiles {
+		return set, errors.New("Messages can only have up to " + strconv.Itoa(maxMessageFiles) + " files")
+	}
+	for _, path := range files {
+		_, err = readAttachment(path)
+		if err != nil {
+			return set, errors.New("Cannot attach file: " + err.Error())
+		}
+	}
+	if len(directory) > 0 {
+		_, err = randomFile(directory)
+		if err != nil {
+			return set, errors.New("Cannot attach file from directory: " + err.Error())
+		}
+	}
+	set.files = files
+	set.directory = directory
+	return set, nil
+}
+
+// attachments returns the files to attach to a single response.
+func (a attachmentSet) attachments() (attachments []*discordgo.File, err error) {
+	paths := a.files
+	if len(a.directory) > 0 {
+		path, err := randomFile(a.directory)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths[:len(paths):len(paths)], path)
+	}
+	total := 0
+	for _, path := range paths {
+		file, err := newAttachment(path)
+		if err != nil {
+			return nil, err
+		}
+		total += file.Reader.(*bytes.Reader).Len()
+		attachments = append(attachments, file)
+	}
+	if total > uploadLimit {
+		return nil, errors.New("attachments are too large to upload together (" + strconv.Itoa(total) + " bytes)")
+	}
+	return attachments, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth profile types.
+const (
+	authBasic  = "basic"
+	authBearer = "bearer"
+	authOAuth2 = "oauth2"
+	authHMAC   = "hmac"
+)
+
+// AuthProfileConfig is the configuration for a way of authenticating HTTP requests.
+// Profiles are defined once in the bot config and referenced by name from commands,
+// so commands using the same profile share its tokens.
+//
+// Secrets (password, token, clientSecret and secret) can be read from the environment
+// with "env:NAME" or from a file with "file:/path/to/secret"; anything else is used as-is.
+type AuthProfileConfig struct {
+	// Type of the profile: "basic", "bearer", "oauth2" or "hmac".
+	Type string `json:"type"`
+	// Username and password, for basic auth.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Token, for bearer auth.
+	Token string `json:"token"`
+	// Token endpoint, client ID and secret, and scopes, for OAuth2 client credentials.
+	TokenURL     string   `json:"tokenUrl"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+	// Shared secret, for HMAC signing.
+	Secret string `json:"secret"`
+	// Hash to sign with, for HMAC signing: "sha256" (the default), "sha1" or "sha512".
+	Algorithm string `json:"algorithm"`
+	// Header to put the signature in, for HMAC signing. Defaults to "X-Signature".
+	Header string `json:"header"`
+	// Prefix to put before the signature, e.g. "sha256=".
+	Prefix string `json:"prefix"`
+	// Header to put the signing timestamp (in Unix seconds) in, for HMAC signing.
+	// Defaults to "X-Timestamp".
+	TimestampHeader string `json:"timestampHeader"`
+	// Name of the HTTP profile to fetch OAuth2 tokens with.
+	// Defaults to the bot's default profile.
+	HTTPProfile string `json:"httpProfile"`
+}
+
+// authProvider authenticates HTTP requests.
+type authProvider interface {
+	// Adds authentication to a request. body is the request body, for providers that sign it.
+	apply(req *http.Request, body []byte) error
+}
+
+// resolveSecret reads a secret from the environment or a file, if it's written as such.
+func resolveSecret(secret string) (string, error) {
+	switch {
+	case strings.HasPrefix(secret, "env:"):
+		name := strings.TrimPrefix(secret, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("environment variable " + name + " is not set")
+		}
+		return value, nil
+	case strings.HasPrefix(secret, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(secret, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return secret, nil
+}
+
+// Auth providers, by profile name. These are kept between reloads
+// (as long as the profile and its secrets don't change) so OAuth2 tokens don't have to be fetched again.
+// authProfiles are the profiles in the bot config they're created from.
+var (
+	authProvidersMu sync.Mutex
+	authProviders   = make(map[string]authProviderEntry)
+	authProfiles    map[string]AuthProfileConfig
+)
+
+type authProviderEntry struct {
+	config   AuthProfileConfig
+	provider authProvider
+}
+
+// setAuthProfiles sets the auth profiles commands can use, from the bot config.
+func setAuthProfiles(profiles map[string]AuthProfileConfig) {
+	authProvidersMu.Lock()
+	authProfiles = profiles
+	authProvidersMu.Unlock()
+}
+
+// getAuthProvider gets the provider for an auth profile.
+func getAuthProvider(name string) (authProvider, error) {
+	authProvidersMu.Lock()
+	defer authProvidersMu.Unlock()
+	profile, ok := authProfiles[name]
+	if !ok {
+		return nil, errors.New("No auth profile named " + name)
+	}
+	// Secrets are read again every time, so ones that were rotated are picked up on reload,
+	// and the provider is only reused if they're the same
+	resolved, err := profile.resolveSecrets()
+	if err != nil {
+		return nil, errors.New("Error with auth profile " + name + ": " + err.Error())
+	}
+	if entry, ok := authProviders[name]; ok && reflect.DeepEqual(entry.config, resolved) {
+		return entry.provider, nil
+	}
+	provider, err := newAuthProvider(resolved)
+	if err != nil {
+		return nil, errors.New("Error with auth profile " + name + ": " + err.Error())
+	}
+	authProviders[name] = authProviderEntry{
+		config:   resolved,
+		provider: provider,
+	}
+	return provider, nil
+}
+
+// resolveSecrets returns a copy of the profile with its secrets read from the environment or files.
+func (p AuthProfileConfig) resolveSecrets() (resolved AuthProfileConfig, err error) {
+	resolved = p
+	for _, secret := range []*string{&resolved.Password, &resolved.Token, &resolved.ClientSecret, &resolved.Secret} {
+		*secret, err = resolveSecret(*secret)
+		if err != nil {
+			return resolved, err
+		}
+	}
+	return resolved, nil
+}
+
+// newAuthProvider creates a provider from a profile whose secrets have been resolved.
+func newAuthProvider(profile AuthProfileConfig) (authProvider, error) {
+	switch profile.Type {
+	case authBasic:
+		return basicAuth{username: profile.Username, password: profile.Password}, nil
+	case authBearer:
+		if len(profile.Token) == 0 {
+			return nil, errors.New("bearer auth needs a token")
+		}
+		return bearerAuth{token: profile.Token}, nil
+	case authOAuth2:
+		if len(profile.TokenURL) == 0 || len(profile.ClientID) == 0 {
+			return nil, errors.New("oauth2 auth needs a tokenUrl and clientId")
+		}
+		httpProfile, err := resolveHTTPProfile(profile.HTTPProfile, nil)
+		if err != nil {
+			return nil, err
+		}
+		transport, err := newHTTPTransport(httpProfile)
+		if err != nil {
+			return nil, err
+		}
+		return &oauth2Auth{
+			client:       newHTTPClient(transport, defaultRequestTimeout),
+			tokenURL:     profile.TokenURL,
+			clientID:     profile.ClientID,
+			clientSecret: profile.ClientSecret,
+			scopes:       profile.Scopes,
+		}, nil
+	case authHMAC:
+		if len(profile.Secret) == 0 {
+			return nil, errors.New("hmac auth needs a secret")
+		}
+		auth := hmacAuth{
+			secret:          []byte(profile.Secret),
+			header:          profile.Header,
+			prefix:          profile.Prefix,
+			timestampHeader: profile.TimestampHeader,
+		}
+		switch profile.Algorithm {
+		case "", "sha256":
+			auth.hash = sha256.New
+		case "sha1":
+			auth.hash = sha1.New
+		case "sha512":
+			auth.hash = sha512.New
+		default:
+			return nil, errors.New("invalid hmac algorithm " + profile.Algorithm)
+		}
+		if len(auth.header) == 0 {
+			auth.header = "X-Signature"
+		}
+		if len(auth.timestampHeader) == 0 {
+			auth.timestampHeader = "X-Timestamp"
+		}
+		return auth, nil
+	default:
+		return nil, errors.New("invalid auth type " + profile.Type)
+	}
+}
+
+type basicAuth struct {
+	username, password string
+}
+
+func (b basicAuth) apply(req *http.Request, body []byte) error {
+	req.SetBasicAuth(b.username, b.password)
+	return nil
+}
+
+type bearerAuth struct {
+	token string
+}
+
+func (b bearerAuth) apply(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return nil
+}
+
+// oauth2Auth gets tokens with the OAuth2 client credentials grant,
+// caching them until shortly before they expire.
+type oauth2Auth struct {
+	client       *http.Client
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// How long before a token expires to get a new one.
+// For tokens that don't last much longer than this, it's a quarter of their lifetime instead.
+const oauth2ExpiryMargin = 30 * time.Second
+
+func (o *oauth2Auth) apply(req *http.Request, body []byte) error {
+	token, err := o.getToken()
+	if err != nil {
+		return errors.New("could not get OAuth2 token: " + err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// getToken returns the cached token, fetching a new one if it's expired.
+func (o *oauth2Auth) getToken() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.token) > 0 && time.Now().Before(o.expires) {
+		return o.token, nil
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.scopes) > 0 {
+		form.Set("scope", strings.Join(o.scopes, " "))
+	}
+	req, err := http.NewRequest("POST", o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", errors.New("token request failed with status " + resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	if len(token.AccessToken) == 0 {
+		return "", errors.New("token response had no access_token")
+	}
+	o.token = token.AccessToken
+	// tokens without an expiry are refreshed hourly, just in case
+	expiresIn := time.Hour
+	if token.ExpiresIn > 0 {
+		expiresIn = time.Duration(token.ExpiresIn) * time.Second
+	}
+	margin := oauth2ExpiryMargin
+	if margin > expiresIn/4 {
+		margin = expiresIn / 4
+	}
+	o.expires = time.Now().Add(expiresIn - margin)
+	return o.token, nil
+}
+
+// invalidate throws away the cached token, e.g. after it's rejected.
+func (o *oauth2Auth) invalidate() {
+	o.mu.Lock()
+	o.token = ""
+	o.mu.Unlock()
+}
+
+// hmacAuth signs requests with an HMAC of the timestamp, method, path and body:
+//
+//	<timestamp>\n<METHOD>\n<path and query>\n<body>
+//
+// The signature is sent hex-encoded in the signature header, and the timestamp
+// in the timestamp header, so the receiver can rebuild the signed string.
+type hmacAuth struct {
+	secret          []byte
+	hash            func() hash.Hash
+	header          string
+	prefix          string
+	timestampHeader string
+}
+
+func (h hmacAuth) apply(req *http.Request, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(h.hash, h.secret)
+	mac.Write([]byte(timestamp + "\n" + req.Method + "\n" + req.URL.RequestURI() + "\n"))
+	mac.Write(body)
+	req.Header.Set(h.timestampHeader, timestamp)
+	req.Header.Set(h.header, h.prefix+hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gregjones/httpcache"
+	log "github.com/sirupsen/logrus" // logging suite
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize is how big the HTTP cache can get, in bytes, if the bot config doesn't say.
+const defaultCacheSize = 64 << 20
+
+// The HTTP cache shared by every command.
+// This lives outside of the commands so it survives reloads.
+// It's created the first time a command that caches is built, from the cacheDir and cacheSize in the bot config;
+// changing them takes a restart.
+var (
+	sharedCacheOnce sync.Once
+	sharedCache     httpcache.Cache
+)
+
+// getSharedCache returns the shared HTTP cache, creating it if necessary.
+func getSharedCache() httpcache.Cache {
+	sharedCacheOnce.Do(func() {
+		size := config.CacheSize
+		if size <= 0 {
+			size = defaultCacheSize
+		}
+		if len(config.CacheDir) > 0 {
+			cache, err := newDiskCache(config.CacheDir, size)
+			if err == nil {
+				log.WithField("dir", config.CacheDir).Info("Using on-disk HTTP cache")
+				sharedCache = cache
+				return
+			}
+			log.WithField("error", err).Error("Unable to create HTTP cache directory, caching in memory instead")
+		}
+		sharedCache = newMemoryCache(size)
+	})
+	return sharedCache
+}
+
+// memoryCache is an httpcache.Cache that keeps responses in memory,
+// evicting the least recently used ones once it's full.
+type memoryCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// Most recently used entries are at the front.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// memoryCacheEntry is an entry in a memoryCache.
+type memoryCacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newMemoryCache(maxSize int64) *memoryCache {
+	return &memoryCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(element)
+	return element.Value.(*memoryCacheEntry).data, true
+}
+
+func (m *memoryCache) Set(key string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	// responses bigger than the whole cache aren't worth keeping
+	if int64(len(data)) > m.maxSize {
+		return
+	}
+	m.entries[key] = m.order.PushFront(&memoryCacheEntry{key: key, data: data})
+	m.size += int64(len(data))
+	for m.size > m.maxSize {
+		oldest := m.order.Back().Value.(*memoryCacheEntry)
+		m.remove(oldest.key)
+	}
+}
+
+func (m *memoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+}
+
+// remove removes an entry. The caller must hold m.mu.
+func (m *memoryCache) remove(key string) {
+	element, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	m.size -= int64(len(element.Value.(*memoryCacheEntry).data))
+	m.order.Remove(element)
+	delete(m.entries, key)
+}
+
+// diskCache is an httpcache.Cache that stores responses as files in a directory,
+// deleting the least recently used ones once it's full.
+type diskCache struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	size    int64
+}
+
+// newDiskCache creates a disk cache, working out how much is already in the directory.
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	d := &diskCache{dir: dir, maxSize: maxSize}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		d.size += file.Size()
+	}
+	d.evict()
+	return d, nil
+}
+
+// path gets the file path of a cache key.
+func (d *diskCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(hash[:]))
+}
+
+func (d *diskCache) Get(key string) ([]byte, bool) {
+	path := d.path(key)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	// the modification time is what eviction goes by, so mark it as used
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+func (d *diskCache) Set(key string, data []byte) {
+	if int64(len(data)) > d.maxSize {
+		return
+	}
+	// write to a temporary file first, so readers never see half a response
+	tmp, err := ioutil.TempFile(d.dir, "tmp-")
+	if err != nil {
+		log.WithField("error", err).Error("Unable to write to HTTP cache")
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := d.path(key)
+	var replaced int64
+	if info, statErr := os.Stat(path); statErr == nil {
+		replaced = info.Size()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.WithField("error", err).Error("Unable to write to HTTP cache")
+		return
+	}
+	d.size += int64(len(data)) - replaced
+	if d.size > d.maxSize {
+		d.evict()
+	}
+}
+
+func (d *diskCache) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := d.path(key)
+	if info, err := os.Stat(path); err == nil && os.Remove(path) == nil {
+		d.size -= info.Size()
+	}
+}
+
+// evict deletes the least recently used files until the cache is under a
+// tenth below its size limit, so it doesn't have to evict on every write.
+// The caller must hold d.mu, unless nothing else can have the cache yet.
+func (d *diskCache) evict() {
+	if d.size <= d.maxSize {
+		return
+	}
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		log.WithField("error", err).Error("Unable to clean up HTTP cache")
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	target := d.maxSize - d.maxSize/10
+	for _, file := range files {
+		if d.size <= target {
+			break
+		}
+		if strings.HasPrefix(file.Name(), "tmp-") {
+			continue
+		}
+		if os.Remove(filepath.Join(d.dir, file.Name())) == nil {
+			d.size -= file.Size()
+		}
+	}
+}
+
+// namespacedCache keeps a set of entries in another cache apart from everything else in it.
+type namespacedCache struct {
+	cache     httpcache.Cache
+	namespace string
+}
+
+func (n namespacedCache) Get(key string) ([]byte, bool) {
+	return n.cache.Get(n.namespace + key)
+}
+
+func (n namespacedCache) Set(key string, data []byte) {
+	n.cache.Set(n.namespace+key, data)
+}
+
+func (n namespacedCache) Delete(key string) {
+	n.cache.Delete(n.namespace + key)
+}
+
+// cacheHeadersKey is the context key for the headers a request is cached by.
+type cacheHeadersKey struct{}
+
+// withCacheHeaders notes the request's current headers as the ones it's cached by.
+// Requests call this before they're authenticated, so signatures and timestamps
+// that change on every request don't stop responses from ever being reused.
+func withCacheHeaders(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheHeadersKey{}, req.Header.Clone()))
+}
+
+// requestNamespace works out the cache namespace of a request. httpcache only keys
+// entries by URL, so this adds everything else that can change the response:
+// the command making the request and its headers, as they were before authentication.
+// Commands never get each other's responses, and each command always uses the same
+// auth profile, so authenticated responses are only reused for the same credentials.
+func requestNamespace(name string, req *http.Request) string {
+	header, ok := req.Context().Value(cacheHeadersKey{}).(http.Header)
+	if !ok {
+		header = req.Header
+	}
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte(key + ": " + strings.Join(header[key], ", ") + "\n"))
+	}
+	return name + "\x00" + hex.EncodeToString(hash.Sum(nil)) + "\x00"
+}
+
+// commandCacheTransport caches a command's responses in the shared cache.
+type commandCacheTransport struct {
+	name  string
+	cache httpcache.Cache
+	base  http.RoundTripper
+}
+
+func (t commandCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := httpcache.NewTransport(namespacedCache{
+		cache:     t.cache,
+		namespace: requestNamespace(t.name, req),
+	})
+	transport.Transport = t.base
+	return transport.RoundTrip(req)
+}
+
+// ttlTransport overrides the caching headers of responses with a fixed TTL,
+// for APIs that send no (or useless) cache headers.
+type ttlTransport struct {
+	base http.RoundTripper
+	ttl  time.Duration
+}
+
+func (t ttlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode < 400 {
+		resp.Header.Set("Cache-Control", "max-age="+strconv.Itoa(int(t.ttl.Seconds())))
+		resp.Header.Del("Expires")
+		resp.Header.Del("Pragma")
+	}
+	return resp, nil
+}
+
+// newCachingTransport wraps a command's transport with the shared cache.
+// If ttl is set, it overrides the cache headers of responses; since entries are
+// kept per command, this doesn't affect other commands requesting the same URLs.
+func newCachingTransport(name string, base http.RoundTripper, ttl time.Duration) http.RoundTripper {
+	if ttl > 0 {
+		base = ttlTransport{base: base, ttl: ttl}
+	}
+	// get the cache now, so it's never created from the config while a reload is replacing it
+	return commandCacheTransport{name: name, cache: getSharedCache(), base: base}
+}
+
+// cacheStatus describes whether a response came from the cache, for logging.
+func cacheStatus(resp *http.Response) string {
+	if resp.Header.Get(httpcache.XFromCache) == "1" {
+		return "hit"
+	}
+	return "miss"
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"  // for running the bot
+	log "github.com/sirupsen/logrus" // logging suite
+	"strconv"
+	"strings"
+)
+
+// ComponentConfig is the config for a single message component,
+// which is either a button or a select menu.
+type ComponentConfig struct {
+	// Type of the component. Either "button" or "select".
+	Type string `json:"type"`
+	// Custom ID of the component. This is what interactions are routed by,
+	// so it must be unique across all commands.
+	// Not used for link buttons.
+	CustomID string `json:"customid"`
+	// Button label.
+	Label string `json:"label"`
+	// Button style. One of "primary" (the default), "secondary", "success", "danger" or "link".
+	Style string `json:"style"`
+	// Button emoji, either a unicode emoji or a custom emoji ID.
+	Emoji string `json:"emoji"`
+	// URL to open. Only used (and required) by link buttons.
+	URL string `json:"url"`
+	// Whether the component is disabled.
+	Disabled bool `json:"disabled"`
+	// Select menu placeholder text.
+	Placeholder string `json:"placeholder"`
+	// Minimum number of options that must be picked in a select menu.
+	MinValues int `json:"minvalues"`
+	// Maximum number of options that can be picked in a select menu.
+	MaxValues int `json:"maxvalues"`
+	// Select menu options.
+	Options []SelectOptionConfig `json:"options"`
+	// Action to take when the component is used.
+	Action ComponentAction `json:"action"`
+}
+
+// SelectOptionConfig is the config for a single option in a select menu.
+type SelectOptionConfig struct {
+	Label       string `json:"label"`
+	Value       string `json:"value"`
+	Description string `json:"description"`
+	Emoji       string `json:"emoji"`
+	Default     bool   `json:"default"`
+}
+
+// ComponentAction describes what happens when a component is clicked or selected.
+type ComponentAction struct {
+	// Type of the action. One of:
+	//   "reply"   - reply to the interaction with Content
+	//   "edit"    - replace the content of the message the component is on with Content
+	//   "command" - run the command named in Command
+	//   "rest"    - run a REST call configured by Options
+	Type string `json:"type"`
+	// Content of the reply or edited message.
+	// For "command" and "rest" actions, this is used as the content of the message
+	// the command is run with. If unset, the selected values of a select menu
+	// are used instead.
+	Content string `json:"content"`
+	// Whether a "reply" should only be visible to the user who used the component.
+	Ephemeral bool `json:"ephemeral"`
+	// Name of the command to run for "command" actions.
+	Command string `json:"command"`
+	// Options for "rest" actions. This is the same as the options of a "rest" command.
+	Options json.RawMessage `json:"options"`
+}
+
+// componentRoute is what the Handler uses to route a component interaction to its action.
+type componentRoute struct {
+	// The command the component belongs to. Its whitelists and blacklists are
+	// checked against the user using the component.
+	owner  Command
+	action ComponentAction
+	// Command to run for "command" and "rest" actions.
+	target Command
+}
+
+// componentOwner is implemented by commands that can attach components to their responses.
+type componentOwner interface {
+	getComponents() [][]ComponentConfig
+}
+
+// Button styles, by config name.
+var buttonStyles = map[string]discordgo.ButtonStyle{
+	"":          discordgo.PrimaryButton,
+	"primary":   discordgo.PrimaryButton,
+	"secondary": discordgo.SecondaryButton,
+	"success":   discordgo.SuccessButton,
+	"danger":    discordgo.DangerButton,
+	"link":      discordgo.LinkButton,
+}
+
+// componentEmoji turns a config emoji string into a ComponentEmoji.
+// Purely numeric strings are treated as custom emoji IDs.
+func componentEmoji(emoji string) discordgo.ComponentEmoji {
+	if len(emoji) > 0 && strings.Trim(emoji, "0123456789") == "" {
+		return discordgo.ComponentEmoji{ID: emoji}
+	}
+	return discordgo.ComponentEmoji{Name: emoji}
+}
+
+// buildComponents validates a component config and converts it into
+// action rows that can be sent with a message.
+func buildComponents(rows [][]ComponentConfig) (components []discordgo.MessageComponent, err error) {
+	if len(rows) > 5 {
+		return nil, errors.New("Messages can only have up to 5 component rows")
+	}
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		if len(row) > 5 {
+			return nil, errors.New("Component rows can only have up to 5 components")
+		}
+		var built []discordgo.MessageComponent
+		for _, c := range row {
+			switch c.Type {
+			case "button":
+				style, ok := buttonStyles[c.Style]
+				if !ok {
+					return nil, errors.New("Invalid button style " + c.Style)
+				}
+				button := discordgo.Button{
+					Label:    c.Label,
+					Style:    style,
+					Disabled: c.Disabled,
+					Emoji:    componentEmoji(c.Emoji),
+				}
+				if style == discordgo.LinkButton {
+					if len(c.URL) == 0 {
+						return nil, errors.New("Link buttons must have a url")
+					}
+					button.URL = c.URL
+				} else {
+					if len(c.CustomID) == 0 {
+						return nil, errors.New("Button " + c.Label + " must have a customid")
+					}
+					button.CustomID = c.CustomID
+				}
+				built = append(built, button)
+			case "select":
+				// select menus take up a whole row
+				if len(row) > 1 {
+					return nil, errors.New("Select menus must be alone in their row")
+				}
+				if len(c.CustomID) == 0 {
+					return nil, errors.New("Select menus must have a customid")
+				}
+				if len(c.Options) == 0 || len(c.Options) > 25 {
+					return nil, errors.New("Select menu " + c.CustomID + " must have between 1 and 25 options")
+				}
+				menu := discordgo.SelectMenu{
+					CustomID:    c.CustomID,
+					Placeholder: c.Placeholder,
+					MaxValues:   c.MaxValues,
+					Disabled:    c.Disabled,
+				}
+				if c.MinValues > 0 {
+					minValues := c.MinValues
+					menu.MinValues = &minValues
+				}
+				for _, option := range c.Options {
+					menu.Options = append(menu.Options, discordgo.SelectMenuOption{
+						Label:       option.Label,
+						Value:       option.Value,
+						Description: option.Description,
+						Emoji:       componentEmoji(option.Emoji),
+						Default:     option.Default,
+					})
+				}
+				built = append(built, menu)
+			default:
+				return nil, errors.New("Invalid component type " + c.Type)
+			}
+		}
+		components = append(components, discordgo.ActionsRow{Components: built})
+	}
+	return components, nil
+}
+
+// addComponentRoutes registers the component actions of a command with the handler.
+// This has to run after all commands are parsed, so "command" actions can find their target.
+func (c *Handler) addComponentRoutes(owner Command, rows [][]ComponentConfig) error {
+	for _, row := range rows {
+		for _, component := range row {
+			// link buttons don't send interactions
+			if len(component.CustomID) == 0 || component.Style == "link" {
+				continue
+			}
+			if _, exists := c.components[component.CustomID]; exists {
+				return errors.New("Duplicate component customid " + component.CustomID)
+			}
+			route := componentRoute{
+				owner:  owner,
+				action: component.Action,
+			}
+			switch component.Action.Type {
+			case "reply", "edit":
+			case "command":
+				target, ok := c.named[component.Action.Command]
+				if !ok {
+					return errors.New("Component " + component.CustomID + " refers to nonexistent command " + component.Action.Command)
+				}
+				route.target = target
+			case "rest":
+				target, err := NewRESTCommand(BaseCommand{
+					Name:    owner.GetName() + "/" + component.CustomID,
+					Type:    "rest",
+					Options: component.Action.Options,
+				})
+				if err != nil {
+					return errors.New("Error with component " + component.CustomID + ": " + err.Error())
+				}
+				route.target = target
+			default:
+				return errors.New("Component " + component.CustomID + " has invalid action type (" + component.Action.Type + ")")
+			}
+			c.components[component.CustomID] = route
+		}
+	}
+	return nil
+}
+
+// HandleInteraction handles a Discord interaction, routing component interactions
+// to the action configured for the component's custom ID.
+func (c *Handler) HandleInteraction(bot *discordgo.Session, evt *discordgo.InteractionCreate) {
+	if evt.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	// Like messages, only handle interactions in guilds
+	if evt.GuildID == "" || evt.Member == nil {
+		return
+	}
+	data := evt.MessageComponentData()
+	route, ok := c.components[data.CustomID]
+	if !ok {
+		return
+	}
+	user := evt.Member.User
+	fields := log.Fields{
+		"customID":  data.CustomID,
+		"values":    data.Values,
+		"command":   route.owner.GetName(),
+		"action":    route.action.Type,
+		"userID":    user.ID,
+		"username":  user.Username + "#" + user.Discriminator,
+		"guildID":   evt.GuildID,
+		"channelID": evt.ChannelID,
+	}
+	// Apply the owning command's whitelists and blacklists to the user using the component
+	if !route.owner.Check(evt.GuildID, evt.ChannelID, user.ID) ||
+		(route.target != nil && !route.target.Check(evt.GuildID, evt.ChannelID, user.ID)) {
+		log.WithFields(fields).Info("Component use denied")
+		err := bot.InteractionRespond(evt.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "You can't use that.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			log.WithFields(fields).WithField("error", err).Error("Component failed")
+		}
+		return
+	}
+	log.WithFields(fields).Info("Component used")
+	err := route.run(bot, evt, data)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Component failed")
+	}
+}
+
+// run performs the route's action.
+func (r componentRoute) run(bot *discordgo.Session, evt *discordgo.InteractionCreate, data discordgo.MessageComponentInteractionData) error {
+	switch r.action.Type {
+	case "reply":
+		response := &discordgo.InteractionResponseData{
+			Content: r.action.Content,
+		}
+		if r.action.Ephemeral {
+			response.Flags = discordgo.MessageFlagsEphemeral
+		}
+		return bot.InteractionRespond(evt.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: response,
+		})
+	case "edit":
+		// keep the embeds and components of the original message
+		return bot.InteractionRespond(evt.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content:    r.action.Content,
+				Embeds:     evt.Message.Embeds,
+				Components: evt.Message.Components,
+			},
+		})
+	default:
+		content := r.action.Content
+		if len(content) == 0 {
+			content = strings.Join(data.Values, " ")
+		}
+		msg := &discordgo.MessageCreate{
+			Message: &discordgo.Message{
+				ID:        evt.Message.ID,
+				ChannelID: evt.ChannelID,
+				GuildID:   evt.GuildID,
+				Author:    evt.Member.User,
+				Content:   content,
+			},
+		}
+		// Commands expect their trigger to have matched (e.g. to get capture groups),
+		// so only run them for content that would trigger them from a message
+		if r.action.Type == "command" && !r.target.Test(bot, msg) {
+			return errors.New("content " + strconv.Quote(content) + " doesn't trigger command " + r.target.GetName())
+		}
+		// Acknowledge the interaction so the client doesn't show it as failed,
+		// then run the target command as if the user sent a message
+		err := bot.InteractionRespond(evt.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredMessageUpdate,
+		})
+		if err != nil {
+			return err
+		}
+		events.emit(componentEvent(eventCommandFired, r.target, msg, data.CustomID))
+		err = r.target.Run(bot, msg)
+		if err != nil {
+			failed := componentEvent(eventCommandFailed, r.target, msg, data.CustomID)
+			failed.Error = err.Error()
+			events.emit(failed)
+		}
+		return err
+	}
+}
+
+// componentEvent describes a command being run from a component.
+func componentEvent(eventType string, cmd Command, msg *discordgo.MessageCreate, customID string) Event {
+	event := commandEvent(eventType, cmd, msg)
+	event.Component = customID
+	return event
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo" // for running the bot
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MessageContext is the data templates get about the message that triggered a command.
+type MessageContext struct {
+	// Full text of the message.
+	Content string
+	// Author of the message.
+	Author UserContext
+	// Channel the message was sent in.
+	Channel ChannelContext
+	// Guild the message was sent in.
+	Guild GuildContext
+	// Numbered capture groups of the trigger regex, if the command has one.
+	// Groups[0] is the whole match.
+	Groups []string
+	// Named capture groups of the trigger regex, if the command has one.
+	// Groups that didn't match are empty.
+	Named map[string]string
+	// Words of the message after the first one, e.g. the arguments of "!weather new york".
+	Args []string
+	// Time the message was handled.
+	Now time.Time
+	// Parsed responses of the steps of a chained REST command that have run so far, by name.
+	Steps map[string]interface{}
+	// The same responses, in order.
+	Results []interface{}
+}
+
+// UserContext describes a user for templates.
+type UserContext struct {
+	ID   string
+	Name string
+	// Username with discriminator, e.g. "valerius#1234".
+	Tag     string
+	Mention string
+}
+
+// ChannelContext describes a channel for templates.
+type ChannelContext struct {
+	ID string
+	// Name of the channel, if it's in the bot's state cache.
+	Name    string
+	Mention string
+}
+
+// GuildContext describes a guild for templates.
+type GuildContext struct {
+	ID string
+	// Name of the guild, if it's in the bot's state cache.
+	Name string
+}
+
+// newMessageContext builds the template context for a message.
+// If rgx is set, its capture groups are matched against the message content.
+func newMessageContext(bot *discordgo.Session, evt *discordgo.MessageCreate, rgx *regexp.Regexp) MessageContext {
+	ctx := MessageContext{
+		Content: evt.Message.Content,
+		Channel: ChannelContext{
+			ID:      evt.Message.ChannelID,
+			Mention: "<#" + evt.Message.ChannelID + ">",
+		},
+		Guild: GuildContext{
+			ID: evt.Message.GuildID,
+		},
+		Named: make(map[string]string),
+		Now:   time.Now(),
+	}
+	if words := strings.Fields(evt.Message.Content); len(words) > 1 {
+		ctx.Args = words[1:]
+	}
+	if author := evt.Message.Author; author != nil {
+		ctx.Author = UserContext{
+			ID:      author.ID,
+			Name:    author.Username,
+			Tag:     author.Username + "#" + author.Discriminator,
+			Mention: author.Mention(),
+		}
+	}
+	// fill in names from the state cache, if we have them
+	if bot != nil && bot.State != nil {
+		if channel, err := bot.State.Channel(evt.Message.ChannelID); err == nil {
+			ctx.Channel.Name = channel.Name
+		}
+		if guild, err := bot.State.Guild(evt.Message.GuildID); err == nil {
+			ctx.Guild.Name = guild.Name
+		}
+	}
+	if rgx != nil {
+		ctx.setMatch(rgx, rgx.FindStringSubmatch(evt.Message.Content))
+	}
+	return ctx
+}
+
+// setMatch sets the capture groups from a match of rgx.
+func (ctx *MessageContext) setMatch(rgx *regexp.Regexp, groups []string) {
+	ctx.Groups = groups
+	ctx.Named = make(map[string]string)
+	for i, name := range rgx.SubexpNames() {
+		if len(name) > 0 && i < len(groups) {
+			ctx.Named[name] = groups[i]
+		}
+	}
+}
+
+// newMatchContexts builds a template context for each distinct match of rgx in a message,
+// up to max matches. Matches with identical capture groups only get one context.
+func newMatchContexts(bot *discordgo.Session, evt *discordgo.MessageCreate, rgx *regexp.Regexp, max int) []MessageContext {
+	base := newMessageContext(bot, evt, nil)
+	var contexts []MessageContext
+	seen := make(map[string]bool)
+	for _, groups := range rgx.FindAllStringSubmatch(evt.Message.Content, -1) {
+		if len(contexts) >= max {
+			break
+		}
+		key := strings.Join(groups[1:], "\x00")
+		if len(groups) == 1 {
+			key = groups[0]
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ctx := base
+		ctx.setMatch(rgx, groups)
+		contexts = append(contexts, ctx)
+	}
+	return contexts
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression. Each field is a bitset of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Whether the day fields start with "*" (like "*" or "*/2"). Like in cron, if both
+	// day fields are restricted, a day matches if either of them does.
+	domStar, dowStar bool
+	// Whether the hour field starts with "*". Schedules for set hours only run once
+	// when clocks go back, like in cron, while ones that run every hour keep doing so.
+	hourStar bool
+}
+
+// cronField describes the range of values a cron field can have.
+type cronField struct {
+	name     string
+	min, max int
+	// Names that can be used for values, e.g. "jan".
+	names map[string]int
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDOM    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is also Sunday, as in most crons.
+	cronDOW = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// Shorthands for common schedules.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard five-field cron expression (minute, hour, day of month,
+// month and day of week), or one of the @ shorthands like "@daily".
+// Fields can be "*", values, ranges ("1-5"), steps ("*/15", "0-30/10") and lists of those,
+// and months and days of the week can be written as names ("jan", "mon").
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(strings.ToLower(spec))
+	if expanded, ok := cronDescriptors[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expressions need 5 fields: minute, hour, day of month, month and day of week")
+	}
+	var (
+		schedule cronSchedule
+		err      error
+	)
+	for i, target := range []struct {
+		field cronField
+		bits  *uint64
+	}{
+		{cronMinute, &schedule.minute},
+		{cronHour, &schedule.hour},
+		{cronDOM, &schedule.dom},
+		{cronMonth, &schedule.month},
+		{cronDOW, &schedule.dow},
+	} {
+		*target.bits, err = target.field.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Sunday can be 0 or 7
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	// Vixie cron counts a field as unrestricted if it starts with *, steps and all
+	schedule.domStar = strings.HasPrefix(fields[2], "*")
+	schedule.dowStar = strings.HasPrefix(fields[4], "*")
+	schedule.hourStar = strings.HasPrefix(fields[1], "*")
+	return &schedule, nil
+}
+
+// parse parses one field of a cron expression into a bitset.
+func (f cronField) parse(field string) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		// split off the step, if any
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.New("Invalid step in " + f.name + " field: " + part)
+			}
+			part = part[:i]
+		}
+		// work out the range
+		var low, high int
+		switch {
+		case part == "*":
+			low, high = f.min, f.max
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			low, err = f.value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+			high, err = f.value(bounds[1])
+			if err != nil {
+				return 0, err
+			}
+			if high < low {
+				return 0, errors.New("Invalid range in " + f.name + " field: " + part)
+			}
+		default:
+			low, err = f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			high = low
+			// "5/10" means from 5 to the end, every 10
+			if step > 1 {
+				high = f.max
+			}
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single value of a field.
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.New("Invalid " + f.name + " " + s)
+	}
+	return v, nil
+}
+
+// matchesDay checks if the schedule runs on a day.
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the schedule runs, in t's location.
+// It returns the zero time if it never runs (e.g. on February 30th).
+// Times skipped when clocks go forward for daylight saving are skipped, and
+// schedules for set hours don't run again in the hour repeated when they go back.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	after := wallClock(t)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0, !c.hourStar && !wallClock(t).After(after):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// times skipped by daylight saving can normalize to before t, so make sure we move on
+		if !next.After(t) {
+			next = t.Add(time.Hour)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// wallClock gets the time on the clock at t, without its zone, so times in
+// the hour repeated at the end of daylight saving compare as the same.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04 MST", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want string
+	}{
+		// 2021-03-01 was a Monday
+		{"every minute", "* * * * *", "2021-03-01 10:00 UTC", "2021-03-01 10:01 UTC"},
+		{"daily", "@daily", "2021-03-01 10:00 UTC", "2021-03-02 00:00 UTC"},
+		{"step range", "0-30/10 9 * * *", "2021-03-01 09:05 UTC", "2021-03-01 09:10 UTC"},
+		{"step range end", "0-30/10 9 * * *", "2021-03-01 09:31 UTC", "2021-03-02 09:00 UTC"},
+		{"step from value", "5/20 * * * *", "2021-03-01 10:30 UTC", "2021-03-01 10:45 UTC"},
+		{"list and names", "0 12 * * mon,fri", "2021-03-01 12:00 UTC", "2021-03-05 12:00 UTC"},
+		{"sunday as 7", "0 0 * * 7", "2021-03-01 00:00 UTC", "2021-03-07 00:00 UTC"},
+		// if both day fields are restricted, either matching is enough
+		{"day of month or week", "0 0 15 * fri", "2021-03-01 00:00 UTC", "2021-03-05 00:00 UTC"},
+		{"day of month or week, month day first", "0 0 3 * fri", "2021-03-01 00:00 UTC", "2021-03-03 00:00 UTC"},
+		// but a day field starting with * still counts as unrestricted
+		{"stepped day of month and day of week", "0 0 */2 * fri", "2021-03-01 00:00 UTC", "2021-03-05 00:00 UTC"},
+		{"day of month and stepped day of week", "0 0 13 * */2", "2021-03-01 00:00 UTC", "2021-03-13 00:00 UTC"},
+		{"month rollover", "0 0 1 * *", "2021-03-15 00:00 UTC", "2021-04-01 00:00 UTC"},
+		{"year rollover", "0 0 1 jan *", "2021-03-15 00:00 UTC", "2022-01-01 00:00 UTC"},
+		{"31st skips short months", "0 0 31 * *", "2021-03-31 00:00 UTC", "2021-05-31 00:00 UTC"},
+		{"leap day", "0 0 29 2 *", "2021-03-01 00:00 UTC", "2024-02-29 00:00 UTC"},
+		{"never", "0 0 30 2 *", "2021-03-01 00:00 UTC", ""},
+		// clocks went forward at 2am on 2021-03-14, so 2:30 didn't happen that day
+		{"dst gap", "30 2 * * *", "2021-03-14 00:00 EST", "2021-03-15 02:30 EDT"},
+		{"dst gap hourly", "0 * * * *", "2021-03-14 01:30 EST", "2021-03-14 03:00 EDT"},
+		// clocks went back at 2am on 2021-11-07, so 1:30 happened twice
+		{"dst overlap", "30 1 * * *", "2021-11-07 00:00 EDT", "2021-11-07 01:30 EDT"},
+		{"dst overlap runs once", "30 1 * * *", "2021-11-07 01:30 EDT", "2021-11-08 01:30 EST"},
+		{"dst overlap hourly runs twice", "30 * * * *", "2021-11-07 01:30 EDT", "2021-11-07 01:30 EST"},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		loc := time.UTC
+		if test.from[len(test.from)-3:] != "UTC" {
+			loc = newYork
+		}
+		got := schedule.next(at(loc, test.from))
+		if len(test.want) == 0 {
+			if !got.IsZero() {
+				t.Errorf("%s: got %s, want never", test.name, got)
+			}
+			continue
+		}
+		want := at(loc, test.want)
+		if !got.Equal(want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
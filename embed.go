@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"github.com/bwmarrin/discordgo" // for running the bot
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// Discord's limits on embed sizes, in characters.
+const (
+	embedTitleLimit       = 256
+	embedDescriptionLimit = 4096
+	embedFieldCountLimit  = 25
+	embedFieldNameLimit   = 256
+	embedFieldValueLimit  = 1024
+	embedFooterLimit      = 2048
+	embedTotalLimit       = 6000
+)
+
+// EmbedConfig is the config for a rich embed response.
+// Every string in it is a template, executed with the same data as the command's text response.
+type EmbedConfig struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	// Color of the embed, either in hex ("#ff8800") or decimal.
+	Color string `json:"color"`
+	// Fields of the embed. Fields whose name or value render empty are left out,
+	// so fields can be made conditional.
+	Fields []EmbedFieldConfig `json:"fields"`
+	// URL of the thumbnail image.
+	Thumbnail string `json:"thumbnail"`
+	// URL of the main image.
+	Image  string `json:"image"`
+	Footer string `json:"footer"`
+	// Timestamp, in RFC3339 format.
+	Timestamp string `json:"timestamp"`
+}
+
+// EmbedFieldConfig is the config for a single embed field.
+type EmbedFieldConfig struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+// embedTemplate is a compiled EmbedConfig.
+// Any template that was empty in the config is nil here.
+type embedTemplate struct {
+	title       *template.Template
+	description *template.Template
+	url         *template.Template
+	color       *template.Template
+	fields      []embedFieldTemplate
+	thumbnail   *template.Template
+	image       *template.Template
+	footer      *template.Template
+	timestamp   *template.Template
+}
+
+type embedFieldTemplate struct {
+	name   *template.Template
+	value  *template.Template
+	inline bool
+}
+
+// newEmbedTemplate compiles all the templates in an EmbedConfig.
+func newEmbedTemplate(name string, config EmbedConfig) (embed *embedTemplate, err error) {
+	if len(config.Fields) > embedFieldCountLimit {
+		return nil, errors.New("Embeds can only have up to " + strconv.Itoa(embedFieldCountLimit) + " fields")
+	}
+	// compile optional templates, leaving them nil if unset
+	compile := func(part, text string) *template.Template {
+		if err != nil || len(text) == 0 {
+			return nil
+		}
+		var tmpl *template.Template
+		tmpl, err = newTemplate(name+" embed "+part, text)
+		if err != nil {
+			err = errors.New("Failed to compile embed " + part + " template: " + err.Error())
+		}
+		return tmpl
+	}
+	embed = &embedTemplate{
+		title:       compile("title", config.Title),
+		description: compile("description", config.Description),
+		url:         compile("url", config.URL),
+		color:       compile("color", config.Color),
+		thumbnail:   compile("thumbnail", config.Thumbnail),
+		image:       compile("image", config.Image),
+		footer:      compile("footer", config.Footer),
+		timestamp:   compile("timestamp", config.Timestamp),
+	}
+	for i, field := range config.Fields {
+		embed.fields = append(embed.fields, embedFieldTemplate{
+			name:   compile("field "+strconv.Itoa(i)+" name", field.Name),
+			value:  compile("field "+strconv.Itoa(i)+" value", field.Value),
+			inline: field.Inline,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return embed, nil
+}
+
+// render executes the embed's templates and validates the result against Discord's limits.
+func (e *embedTemplate) render(data interface{}) (embed *discordgo.MessageEmbed, err error) {
+	// execute optional templates, leaving the result empty if unset
+	execute := func(tmpl *template.Template) string {
+		if err != nil || tmpl == nil {
+			return ""
+		}
+		var out string
+		out, err = executeTemplate(tmpl, data)
+		return strings.TrimSpace(out)
+	}
+	embed = &discordgo.MessageEmbed{
+		Title:       execute(e.title),
+		Description: execute(e.description),
+		URL:         execute(e.url),
+	}
+	if thumbnail := execute(e.thumbnail); len(thumbnail) > 0 {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: thumbnail}
+	}
+	if image := execute(e.image); len(image) > 0 {
+		embed.Image = &discordgo.MessageEmbedImage{URL: image}
+	}
+	if footer := execute(e.footer); len(footer) > 0 {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: footer}
+	}
+	for _, field := range e.fields {
+		name, value := execute(field.name), execute(field.value)
+		if len(name) == 0 || len(value) == 0 {
+			continue
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   name,
+			Value:  value,
+			Inline: field.inline,
+		})
+	}
+	color := execute(e.color)
+	timestamp := execute(e.timestamp)
+	if err != nil {
+		return nil, errors.New("could not execute embed template: " + err.Error())
+	}
+	if len(color) > 0 {
+		embed.Color, err = parseColor(color)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(timestamp) > 0 {
+		t, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return nil, errors.New("invalid embed timestamp: " + err.Error())
+		}
+		embed.Timestamp = t.Format(time.RFC3339)
+	}
+	return embed, validateEmbed(embed)
+}
+
+// parseColor parses a color in hex ("#ff8800" or "0xff8800") or decimal.
+func parseColor(color string) (int, error) {
+	var (
+		c   int64
+		err error
+	)
+	if strings.HasPrefix(color, "#") {
+		c, err = strconv.ParseInt(color[1:], 16, 32)
+	} else if strings.HasPrefix(color, "0x") {
+		c, err = strconv.ParseInt(color[2:], 16, 32)
+	} else {
+		c, err = strconv.ParseInt(color, 10, 32)
+	}
+	if err != nil || c < 0 || c > 0xffffff {
+		return 0, errors.New("invalid embed color " + color)
+	}
+	return int(c), nil
+}
+
+// validateEmbed checks an embed against Discord's size limits,
+// so we can fail with a useful error instead of a 400 from Discord.
+func validateEmbed(embed *discordgo.MessageEmbed) error {
+	total := 0
+	check := func(part, text string, limit int) error {
+		n := utf8.RuneCountInString(text)
+		if n > limit {
+			return errors.New("embed " + part + " is too long (" + strconv.Itoa(n) + "/" + strconv.Itoa(limit) + " characters)")
+		}
+		total += n
+		return nil
+	}
+	if err := check("title", embed.Title, embedTitleLimit); err != nil {
+		return err
+	}
+	if err := check("description", embed.Description, embedDescriptionLimit); err != nil {
+		return err
+	}
+	if len(embed.Fields) > embedFieldCountLimit {
+		return errors.New("embed has too many fields")
+	}
+	for _, field := range embed.Fields {
+		if err := check("field name", field.Name, embedFieldNameLimit); err != nil {
+			return err
+		}
+		if err := check("field value", field.Value, embedFieldValueLimit); err != nil {
+			return err
+		}
+	}
+	if embed.Footer != nil {
+		if err := check("footer", embed.Footer.Text, embedFooterLimit); err != nil {
+			return err
+		}
+	}
+	if total > embedTotalLimit {
+		return errors.New("embed is too long (" + strconv.Itoa(total) + "/" + strconv.Itoa(embedTotalLimit) + " characters)")
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"  // for running the bot
+	log "github.com/sirupsen/logrus" // logging suite
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Bot events that can be sent to event hooks.
+const (
+	eventCommandFired  = "command.fired"
+	eventCommandFailed = "command.failed"
+	eventReload        = "reload"
+	eventStartup       = "startup"
+	eventShutdown      = "shutdown"
+)
+
+// Limits for event hook delivery.
+const (
+	// How many deliveries can be waiting before new events are dropped.
+	eventQueueSize      = 256
+	defaultEventRetries = 3
+	eventHookTimeout    = 10 * time.Second
+	// How long to wait for pending events to be delivered when shutting down.
+	eventDrainTimeout = 5 * time.Second
+)
+
+// EventHookConfig configures a webhook the bot sends its events to,
+// e.g. to feed command usage into a dashboard or alert on failures.
+type EventHookConfig struct {
+	// URL to POST events to.
+	URL string `json:"url"`
+	// Events to send: "command.fired", "command.failed", "reload", "startup" and "shutdown".
+	// If unset, every event is sent.
+	Events []string `json:"events"`
+	// Template for the request body, executed with the Event.
+	// If unset, the event is sent as JSON.
+	Template string `json:"template"`
+	// Content type of the body. Defaults to "application/json".
+	ContentType string `json:"contentType"`
+	// Headers to send.
+	Headers map[string]string `json:"headers"`
+	// Name of the auth profile to authenticate with.
+	Auth string `json:"auth"`
+	// Name of the HTTP profile to send with.
+	HTTPProfile string `json:"httpProfile"`
+	// How many times to retry failed deliveries, up to 10. Defaults to 3; set to -1 to not retry.
+	Retries int `json:"retries"`
+}
+
+// Event is something that happened in the bot, as sent to event hooks.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Command the event is about, for command events.
+	Command     string `json:"command,omitempty"`
+	CommandType string `json:"commandType,omitempty"`
+	// The message that triggered the command, for command events.
+	Text      string `json:"text,omitempty"`
+	UserID    string `json:"userId,omitempty"`
+	Username  string `json:"username,omitempty"`
+	GuildID   string `json:"guildId,omitempty"`
+	ChannelID string `json:"channelId,omitempty"`
+	// Custom ID of the button or select menu that ran the command, if one did.
+	Component string `json:"component,omitempty"`
+	// What went wrong, for failures.
+	Error string `json:"error,omitempty"`
+	// Number of commands loaded, for startup and reload events.
+	Commands int `json:"commands,omitempty"`
+}
+
+// eventHook is a compiled EventHookConfig.
+type eventHook struct {
+	EventHookConfig
+	template *template.Template
+	auth     authProvider
+	client   *http.Client
+	retry    retryPolicy
+}
+
+// eventDelivery is an event waiting to be sent to a hook.
+type eventDelivery struct {
+	hook  *eventHook
+	event Event
+}
+
+// eventDispatcher delivers events to hooks in the background,
+// so slow receivers never hold up the bot.
+type eventDispatcher struct {
+	mu    sync.Mutex
+	hooks []*eventHook
+	queue chan eventDelivery
+	// Deliveries that are queued or being sent.
+	pending sync.WaitGroup
+}
+
+// events is the bot's event dispatcher.
+var events = newEventDispatcher()
+
+// newEventDispatcher creates an event dispatcher, and starts its worker.
+func newEventDispatcher() *eventDispatcher {
+	d := &eventDispatcher{
+		queue: make(chan eventDelivery, eventQueueSize),
+	}
+	go d.work()
+	return d
+}
+
+// newEventHooks compiles the event hooks in the bot config.
+func newEventHooks(configs []EventHookConfig) ([]*eventHook, error) {
+	var hooks []*eventHook
+	for i, hookconfig := range configs {
+		hook, err := newEventHook(hookconfig)
+		if err != nil {
+			return nil, errors.New("Error with event hook " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// setHooks replaces the dispatcher's hooks.
+// Events already queued still go to the old hooks.
+func (d *eventDispatcher) setHooks(hooks []*eventHook) {
+	d.mu.Lock()
+	d.hooks = hooks
+	d.mu.Unlock()
+}
+
+// newEventHook compiles an EventHookConfig.
+func newEventHook(config EventHookConfig) (hook *eventHook, err error) {
+	if checkFeedURL(config.URL) != nil {
+		return nil, errors.New("url must be an http(s) URL")
+	}
+	if config.Retries > maxRetries {
+		return nil, errors.New("retries cannot be more than " + strconv.Itoa(maxRetries))
+	}
+	hook = &eventHook{
+		EventHookConfig: config,
+		retry: retryPolicy{
+			retries: config.Retries,
+			backoff: time.Second,
+		},
+	}
+	if config.Retries == 0 {
+		hook.retry.retries = defaultEventRetries
+	}
+	if len(config.ContentType) == 0 {
+		hook.ContentType = "application/json"
+	}
+	if len(config.Template) > 0 {
+		hook.template, err = newTemplate("event hook", config.Template)
+		if err != nil {
+			return nil, errors.New("Failed to compile template: " + err.Error())
+		}
+	}
+	if len(config.Auth) > 0 {
+		hook.auth, err = getAuthProvider(config.Auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	profile, err := resolveHTTPProfile(config.HTTPProfile, nil)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newHTTPTransport(profile)
+	if err != nil {
+		return nil, err
+	}
+	hook.client = newHTTPClient(transport, eventHookTimeout)
+	return hook, nil
+}
+
+// emit queues an event for every hook that wants it.
+// If the queue is full, the event is dropped rather than waiting.
+func (d *eventDispatcher) emit(event Event) {
+	event.Time = time.Now()
+	d.mu.Lock()
+	hooks := d.hooks
+	d.mu.Unlock()
+	for _, hook := range hooks {
+		if len(hook.Events) > 0 && !listContains(hook.Events, event.Type) {
+			continue
+		}
+		d.pending.Add(1)
+		select {
+		case d.queue <- eventDelivery{hook: hook, event: event}:
+		default:
+			d.pending.Done()
+			log.WithFields(log.Fields{
+				"event": event.Type,
+				"url":   hook.URL,
+			}).Warn("Event queue is full, dropping event")
+		}
+	}
+}
+
+// work delivers queued events, one at a time.
+func (d *eventDispatcher) work() {
+	for delivery := range d.queue {
+		err := delivery.hook.deliver(delivery.event)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"event": delivery.event.Type,
+				"url":   delivery.hook.URL,
+				"error": err,
+			}).Error("Could not deliver event")
+		}
+		d.pending.Done()
+	}
+}
+
+// drain waits for queued events to be delivered, up to a timeout.
+func (d *eventDispatcher) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warn("Gave up waiting for events to be delivered")
+	}
+}
+
+// deliver sends an event to the hook, retrying if it fails.
+func (h *eventHook) deliver(event Event) error {
+	var body []byte
+	if h.template != nil {
+		rendered, err := executeTemplate(h.template, event)
+		if err != nil {
+			return errors.New("could not execute template: " + err.Error())
+		}
+		body = []byte(rendered)
+	} else {
+		var err error
+		body, err = json.Marshal(event)
+		if err != nil {
+			return err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", h.ContentType)
+		for key, value := range h.Headers {
+			req.Header.Set(key, value)
+		}
+		if h.auth != nil {
+			err = h.auth.apply(req, body)
+			if err != nil {
+				return err
+			}
+		}
+		resp, err := h.client.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 400 {
+				return nil
+			}
+		}
+		if attempt >= h.retry.retries || !shouldRetry(resp, err) {
+			if err != nil {
+				return err
+			}
+			return errors.New("delivery failed with status " + resp.Status)
+		}
+		time.Sleep(h.retry.delay(attempt, resp))
+	}
+}
+
+// commandEvent describes a command being run for a message.
+func commandEvent(eventType string, cmd Command, evt *discordgo.MessageCreate) Event {
+	author := evt.Message.Author
+	return Event{
+		Type:        eventType,
+		Command:     cmd.GetName(),
+		CommandType: cmd.GetType(),
+		Text:        evt.Message.Content,
+		UserID:      author.ID,
+		Username:    author.Username + "#" + author.Discriminator,
+		GuildID:     evt.Message.GuildID,
+		ChannelID:   evt.Message.ChannelID,
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"  // for running the bot
+	log "github.com/sirupsen/logrus" // logging suite
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Limits for feed commands.
+const (
+	defaultFeedInterval = 10 * time.Minute
+	minFeedInterval     = time.Minute
+	// How many new items are posted per feed per poll by default.
+	defaultFeedMaxItems = 5
+	// How many item IDs are remembered per feed.
+	feedSeenLimit = 1000
+)
+
+// defaultFeedResponse is the announcement template used if a feed command doesn't set one.
+const defaultFeedResponse = "**{{.Feed.Title}}**: {{.Title}}\n{{.Link}}"
+
+// FeedCommand polls RSS, Atom and JSON feeds, and posts their new items to channels.
+// Channels can subscribe to feeds from chat, as well as through the config.
+type FeedCommand struct {
+	BaseCommand
+	FeedConfig
+	interval time.Duration
+	template *template.Template
+	embed    *embedTemplate
+	client   *http.Client
+	poller   background
+}
+
+// FeedConfig is the configuration for the FeedCommand.
+type FeedConfig struct {
+	// Command to manage subscriptions from chat, e.g. "!feed". Messages are
+	// "!feed add <url>", "!feed remove <url>" and "!feed list", for the channel they're sent in.
+	// If unset, only the feeds in the config are posted.
+	Trigger string `json:"trigger"`
+	// URLs of feeds to post to channels.
+	Feeds []string `json:"feeds"`
+	// IDs of the channels to post the feeds in feeds to.
+	Channels []string `json:"channels"`
+	// IDs of the users who can add and remove subscriptions. If unset, anyone with
+	// the Manage Channels permission in a channel can manage its subscriptions.
+	Managers []string `json:"managers"`
+	// How often to poll, e.g. "15m". Defaults to 10 minutes, and can't be less than a minute.
+	Interval string `json:"interval"`
+	// Template for new items, executed with a FeedItem.
+	// Defaults to the feed title, item title and link.
+	Response string `json:"response"`
+	// Rich embed to post for new items, rendered with the FeedItem like the response.
+	Embed *EmbedConfig `json:"embed"`
+	// Maximum number of new items to post per feed per poll. Defaults to 5.
+	MaxItems int `json:"maxitems"`
+	// How long to wait for each feed, e.g. "10s". Defaults to 15 seconds.
+	Timeout string `json:"timeout"`
+	// Name of the HTTP profile to fetch feeds with.
+	HTTPProfile string `json:"httpprofile"`
+	// HTTP profile for just this command, instead of a shared one.
+	HTTP *HTTPProfileConfig `json:"http"`
+}
+
+// feedState is what a feed command remembers between polls, and restarts.
+type feedState struct {
+	// Channels subscribed from chat, by feed URL.
+	Subscriptions map[string][]string `json:"subscriptions"`
+	// Polling status, by feed URL.
+	Feeds map[string]*feedStatus `json:"feeds"`
+}
+
+// feedStatus is the polling status of a single feed.
+type feedStatus struct {
+	// Validators from the last response, for conditional requests.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// IDs of items that have been posted (or were there when the feed was first polled).
+	Seen []string `json:"seen"`
+}
+
+// feedResult is the result of fetching a feed.
+type feedResult struct {
+	url          string
+	feed         *Feed
+	etag         string
+	lastModified string
+}
+
+// NewFeedCommand generates a new FeedCommand.
+func NewFeedCommand(config BaseCommand) (command *FeedCommand, err error) {
+	var options FeedConfig
+	err = json.Unmarshal(config.Options, &options)
+	if err != nil {
+		return nil, err
+	}
+	command = &FeedCommand{
+		BaseCommand: config,
+		FeedConfig:  options,
+		interval:    defaultFeedInterval,
+	}
+	if len(options.Interval) > 0 {
+		command.interval, err = time.ParseDuration(options.Interval)
+		if err != nil {
+			return nil, errors.New("Invalid interval: " + err.Error())
+		}
+		if command.interval < minFeedInterval {
+			return nil, errors.New("interval cannot be less than " + minFeedInterval.String())
+		}
+	}
+	if len(options.Feeds) > 0 && len(options.Channels) == 0 {
+		return nil, errors.New("feeds need channels to be posted to")
+	}
+	if len(options.Feeds) == 0 && len(options.Trigger) == 0 {
+		return nil, errors.New("feed commands need feeds or a trigger")
+	}
+	for _, feed := range options.Feeds {
+		err = checkFeedURL(feed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.MaxItems < 0 {
+		return nil, errors.New("maxitems cannot be negative")
+	}
+	if options.MaxItems == 0 {
+		command.MaxItems = defaultFeedMaxItems
+	}
+	// Compile the announcement
+	response := options.Response
+	if len(response) == 0 && options.Embed == nil {
+		response = defaultFeedResponse
+	}
+	if len(response) > 0 {
+		command.template, err = newTemplate(config.Name, response)
+		if err != nil {
+			return nil, errors.New("Failed to compile template: " + err.Error())
+		}
+	}
+	if options.Embed != nil {
+		command.embed, err = newEmbedTemplate(config.Name, *options.Embed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Set up the client
+	timeout := defaultRequestTimeout
+	if len(options.Timeout) > 0 {
+		timeout, err = time.ParseDuration(options.Timeout)
+		if err != nil {
+			return nil, errors.New("Invalid timeout: " + err.Error())
+		}
+	}
+	profile, err := resolveHTTPProfile(options.HTTPProfile, options.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newHTTPTransport(profile)
+	if err != nil {
+		return nil, err
+	}
+	command.client = newHTTPClient(transport, timeout)
+	return command, nil
+}
+
+// checkFeedURL makes sure a feed URL is an http(s) URL.
+func checkFeedURL(feed string) error {
+	u, err := url.Parse(feed)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("Feed " + feed + " is not an http(s) URL")
+	}
+	return nil
+}
+
+// stateKey is the key the command's state is stored under.
+func (f *FeedCommand) stateKey() string {
+	return "feed/" + f.Name
+}
+
+// loadState loads the command's state. The caller must hold its lock.
+func (f *FeedCommand) loadState() (state feedState, err error) {
+	_, err = botState.get(f.stateKey(), &state)
+	if state.Subscriptions == nil {
+		state.Subscriptions = make(map[string][]string)
+	}
+	if state.Feeds == nil {
+		state.Feeds = make(map[string]*feedStatus)
+	}
+	return state, err
+}
+
+// Test checks if the message is a subscription management command.
+func (f *FeedCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate) bool {
+	if len(f.Trigger) == 0 {
+		return false
+	}
+	content := evt.Message.Content
+	return content == f.Trigger || strings.HasPrefix(content, f.Trigger+" ")
+}
+
+// Run manages the subscriptions of the channel the message was sent in.
+func (f *FeedCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) error {
+	args := strings.Fields(strings.TrimPrefix(evt.Message.Content, f.Trigger))
+	channelID := evt.Message.ChannelID
+	var reply string
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		reply, err = f.list(channelID)
+	case len(args) == 2 && (args[0] == "add" || args[0] == "remove"):
+		if !f.canManage(bot, evt.Message.Author.ID, channelID) {
+			reply = "You can't manage this channel's feeds."
+			break
+		}
+		feed := strings.Trim(args[1], "<>")
+		if args[0] == "add" {
+			reply, err = f.subscribe(feed, channelID)
+		} else {
+			reply, err = f.unsubscribe(feed, channelID)
+		}
+	default:
+		reply = "Usage: " + f.Trigger + " add <url>, " + f.Trigger + " remove <url> or " + f.Trigger + " list"
+	}
+	if err != nil {
+		bot.ChannelMessageSend(channelID, "Something went wrong with the feeds.")
+		return err
+	}
+	_, err = bot.ChannelMessageSend(channelID, reply)
+	return err
+}
+
+// canManage checks if a user can manage a channel's subscriptions.
+func (f *FeedCommand) canManage(bot *discordgo.Session, userID, channelID string) bool {
+	if len(f.Managers) > 0 {
+		return listContains(f.Managers, userID)
+	}
+	permissions, err := bot.UserChannelPermissions(userID, channelID)
+	return err == nil && permissions&discordgo.PermissionManageChannels != 0
+}
+
+// list describes the feeds a channel gets.
+func (f *FeedCommand) list(channelID string) (string, error) {
+	unlock := botState.lock(f.stateKey())
+	defer unlock()
+	state, err := f.loadState()
+	if err != nil {
+		return "", err
+	}
+	var feeds []string
+	if listContains(f.Channels, channelID) {
+		feeds = append(feeds, f.Feeds...)
+	}
+	for feed, channels := range state.Subscriptions {
+		if listContains(channels, channelID) && !listContains(feeds, feed) {
+			feeds = append(feeds, feed)
+		}
+	}
+	if len(feeds) == 0 {
+		return "This channel isn't subscribed to any feeds.", nil
+	}
+	sort.Strings(feeds)
+	return "This channel gets:\n<" + strings.Join(feeds, ">\n<") + ">", nil
+}
+
+// subscribe subscribes a channel to a feed, after making sure it's actually a feed.
+func (f *FeedCommand) subscribe(feed, channelID string) (string, error) {
+	if checkFeedURL(feed) != nil {
+		return "That isn't a feed URL.", nil
+	}
+	result, err := f.fetch(feed, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"command": f.Name,
+			"feed":    feed,
+			"error":   err,
+		}).Info("Could not subscribe to feed")
+		return "Couldn't read that feed.", nil
+	}
+	unlock := botState.lock(f.stateKey())
+	defer unlock()
+	state, err := f.loadState()
+	if err != nil {
+		return "", err
+	}
+	if listContains(state.Subscriptions[feed], channelID) {
+		return "This channel is already subscribed to that feed.", nil
+	}
+	state.Subscriptions[feed] = append(state.Subscriptions[feed], channelID)
+	// Start from what's in the feed now, rather than posting everything in it
+	if state.Feeds[feed] == nil {
+		state.Feeds[feed] = f.newStatus(result)
+	}
+	err = botState.set(f.stateKey(), state)
+	if err != nil {
+		return "", err
+	}
+	title := result.feed.Title
+	if len(title) == 0 {
+		title = feed
+	}
+	return "Subscribed this channel to " + title + ".", nil
+}
+
+// unsubscribe unsubscribes a channel from a feed.
+func (f *FeedCommand) unsubscribe(feed, channelID string) (string, error) {
+	unlock := botState.lock(f.stateKey())
+	defer unlock()
+	state, err := f.loadState()
+	if err != nil {
+		return "", err
+	}
+	channels := state.Subscriptions[feed]
+	var kept []string
+	for _, channel := range channels {
+		if channel != channelID {
+			kept = append(kept, channel)
+		}
+	}
+	if len(kept) == len(channels) {
+		return "This channel isn't subscribed to that feed.", nil
+	}
+	if len(kept) == 0 {
+		delete(state.Subscriptions, feed)
+	} else {
+		state.Subscriptions[feed] = kept
+	}
+	err = botState.set(f.stateKey(), state)
+	if err != nil {
+		return "", err
+	}
+	return "Unsubscribed this channel from that feed.", nil
+}
+
+// start starts polling.
+func (f *FeedCommand) start(bot *discordgo.Session) {
+	f.poller.poll(f.interval, func() { f.poll(bot) })
+}
+
+// stop stops polling, waiting for a poll in progress to finish.
+func (f *FeedCommand) stop() {
+	f.poller.stop()
+}
+
+// targets returns the channels to post each feed to.
+func (f *FeedCommand) targets(state feedState) map[string][]string {
+	targets := make(map[string][]string)
+	for _, feed := range f.Feeds {
+		targets[feed] = append(targets[feed], f.Channels...)
+	}
+	for feed, channels := range state.Subscriptions {
+		for _, channel := range channels {
+			if !listContains(targets[feed], channel) {
+				targets[feed] = append(targets[feed], channel)
+			}
+		}
+	}
+	return targets
+}
+
+// poll fetches every feed, and posts their new items.
+func (f *FeedCommand) poll(bot *discordgo.Session) {
+	fields := log.Fields{
+		"command": f.Name,
+	}
+	// Work out what to fetch. The state isn't held while fetching, so chat commands don't have to wait.
+	unlock := botState.lock(f.stateKey())
+	state, err := f.loadState()
+	unlock()
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Could not load feed state")
+		return
+	}
+	var results []feedResult
+	for feed := range f.targets(state) {
+		result, err := f.fetch(feed, state.Feeds[feed])
+		if err != nil {
+			log.WithFields(fields).WithFields(log.Fields{
+				"feed":  feed,
+				"error": err,
+			}).Error("Could not fetch feed")
+			continue
+		}
+		results = append(results, result)
+	}
+	// Work out what's new against the latest state, in case it changed while we were fetching
+	unlock = botState.lock(f.stateKey())
+	defer unlock()
+	state, err = f.loadState()
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Could not load feed state")
+		return
+	}
+	targets := f.targets(state)
+	for _, result := range results {
+		channels, ok := targets[result.url]
+		if !ok {
+			// unsubscribed while we were fetching
+			continue
+		}
+		if result.feed == nil {
+			// not modified
+			continue
+		}
+		status := state.Feeds[result.url]
+		if status == nil {
+			// The first poll just records what's there, rather than posting everything
+			state.Feeds[result.url] = f.newStatus(result)
+			continue
+		}
+		items := f.newItems(status, result.feed)
+		// If a lot of items came in at once, only post the newest
+		if len(items) > f.MaxItems {
+			for _, item := range items[:len(items)-f.MaxItems] {
+				status.markSeen(feedItemID(item))
+			}
+			items = items[len(items)-f.MaxItems:]
+		}
+		// Items are only marked as seen once they're posted, so failed ones are tried again
+		failed := false
+		for _, item := range items {
+			err = announce(bot, channels, f.template, f.embed, item)
+			if err != nil {
+				log.WithFields(fields).WithFields(log.Fields{
+					"feed":  result.url,
+					"error": err,
+				}).Error("Could not post feed item")
+				failed = true
+				continue
+			}
+			status.markSeen(feedItemID(item))
+		}
+		// Keep the old validators if anything failed, or the next poll would get a 304 and never retry
+		if !failed {
+			status.ETag, status.LastModified = result.etag, result.lastModified
+		}
+	}
+	// Forget about feeds nothing gets any more
+	for feed := range state.Feeds {
+		if _, ok := targets[feed]; !ok {
+			delete(state.Feeds, feed)
+		}
+	}
+	err = botState.set(f.stateKey(), state)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Could not save feed state")
+	}
+}
+
+// newStatus starts tracking a feed, marking everything in it as seen.
+func (f *FeedCommand) newStatus(result feedResult) *feedStatus {
+	status := &feedStatus{
+		ETag:         result.etag,
+		LastModified: result.lastModified,
+	}
+	for _, item := range f.newItems(status, result.feed) {
+		status.markSeen(feedItemID(item))
+	}
+	return status
+}
+
+// newItems returns the items of a feed that haven't been seen, oldest first.
+func (f *FeedCommand) newItems(status *feedStatus, feed *Feed) (items []FeedItem) {
+	seen := make(map[string]bool, len(status.Seen))
+	for _, id := range status.Seen {
+		seen[id] = true
+	}
+	// feeds list the newest items first
+	for i := len(feed.Items) - 1; i >= 0; i-- {
+		item := feed.Items[i]
+		id := feedItemID(item)
+		if len(id) == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		items = append(items, item)
+	}
+	return items
+}
+
+// feedItemID identifies a feed item: its GUID, or its link if it doesn't have one.
+func feedItemID(item FeedItem) string {
+	if len(item.GUID) > 0 {
+		return item.GUID
+	}
+	return item.Link
+}
+
+// markSeen records that an item has been posted.
+func (status *feedStatus) markSeen(id string) {
+	status.Seen = append(status.Seen, id)
+	if len(status.Seen) > feedSeenLimit {
+		status.Seen = status.Seen[len(status.Seen)-feedSeenLimit:]
+	}
+}
+
+// fetch fetches a feed, using the validators in its status (if any) to skip unchanged feeds.
+// The result's feed is nil if the feed hasn't changed.
+func (f *FeedCommand) fetch(feed string, status *feedStatus) (result feedResult, err error) {
+	result.url = feed
+	req, err := http.NewRequest("GET", feed, nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/feed+json, application/xml;q=0.9, */*;q=0.8")
+	if status != nil {
+		if len(status.ETag) > 0 {
+			req.Header.Set("If-None-Match", status.ETag)
+		}
+		if len(status.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", status.LastModified)
+		}
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return result, errors.New("could not make request: " + err.Error())
+	}
+	defer resp.Body.Close()
+	log.WithFields(log.Fields{
+		"endpoint": feed,
+		"response": resp.Status,
+	}).Debug("Fetched feed")
+	if resp.StatusCode == http.StatusNotModified {
+		return result, nil
+	}
+	if resp.StatusCode >= 400 {
+		return result, errors.New("request failed with status " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, errors.New("could not read feed: " + err.Error())
+	}
+	result.feed, err = parseFeed(body)
+	if err != nil {
+		return result, err
+	}
+	for i := range result.feed.Items {
+		result.feed.Items[i].Feed = FeedContext{
+			Title: result.feed.Title,
+			Link:  result.feed.Link,
+			URL:   feed,
+		}
+	}
+	result.etag = resp.Header.Get("ETag")
+	result.lastModified = resp.Header.Get("Last-Modified")
+	return result, nil
+}
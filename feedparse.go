@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"golang.org/x/net/html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Feed is a parsed RSS, Atom or JSON Feed document.
+type Feed struct {
+	Title string
+	// Link to the site the feed is for.
+	Link  string
+	Items []FeedItem
+}
+
+// FeedItem is a single entry in a feed. This is what feed announcements are rendered with.
+type FeedItem struct {
+	// Identifier of the item: its GUID or ID, if it has one.
+	GUID  string
+	Title string
+	Link  string
+	// Summary of the item, with any HTML stripped.
+	Summary string
+	Author  string
+	// When the item was published. Zero if the feed doesn't say.
+	Published time.Time
+	// The feed the item is from.
+	Feed FeedContext
+}
+
+// FeedContext describes the feed an item is from, for templates.
+type FeedContext struct {
+	Title string
+	Link  string
+	// URL of the feed itself.
+	URL string
+}
+
+// rssDocument is an RSS 0.9x, 1.0 or 2.0 document.
+type rssDocument struct {
+	Channel struct {
+		Title string    `xml:"title"`
+		Links []rssLink `xml:"link"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	// RSS 1.0 puts items next to the channel rather than in it.
+	Items []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string    `xml:"title"`
+	Links       []rssLink `xml:"link"`
+	GUID        string    `xml:"guid"`
+	Description string    `xml:"description"`
+	PubDate     string    `xml:"pubDate"`
+	Author      string    `xml:"author"`
+	// Dublin Core elements, which RSS 1.0 uses instead.
+	Date    string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Creator string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+}
+
+// rssLink is a link element in an RSS document. Feeds often have Atom links
+// (like <atom:link rel="self">) next to their RSS ones, and encoding/xml can't
+// match elements without a namespace, so this takes both and rssLinkURL sorts them out.
+type rssLink struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+	atomLink
+}
+
+// atomNamespace is the XML namespace of Atom elements.
+const atomNamespace = "http://www.w3.org/2005/Atom"
+
+// atomFeed is an Atom document.
+type atomFeed struct {
+	Title   string      `xml:"title"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Links     []atomLink `xml:"link"`
+	Summary   string     `xml:"summary"`
+	Content   string     `xml:"content"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+// jsonFeed is a JSON Feed document.
+type jsonFeed struct {
+	Title       string `json:"title"`
+	HomePageURL string `json:"home_page_url"`
+	Items       []struct {
+		ID            interface{} `json:"id"`
+		URL           string      `json:"url"`
+		Title         string      `json:"title"`
+		Summary       string      `json:"summary"`
+		ContentText   string      `json:"content_text"`
+		ContentHTML   string      `json:"content_html"`
+		DatePublished string      `json:"date_published"`
+		Author        struct {
+			Name string `json:"name"`
+		} `json:"author"`
+		Authors []struct {
+			Name string `json:"name"`
+		} `json:"authors"`
+	} `json:"items"`
+}
+
+// Date formats feeds use in the wild.
+var feedDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	time.RFC822Z,
+	time.RFC822,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseFeedDate parses a date in any of the formats feeds use, returning the zero time if it can't.
+func parseFeedDate(date string) time.Time {
+	date = strings.TrimSpace(date)
+	for _, layout := range feedDateLayouts {
+		t, err := time.Parse(layout, date)
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// stripHTML turns HTML into plain text.
+func stripHTML(text string) string {
+	if !strings.Contains(text, "<") && !strings.Contains(text, "&") {
+		return strings.TrimSpace(text)
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(text), nil)
+	if err != nil {
+		return strings.TrimSpace(text)
+	}
+	var b strings.Builder
+	for _, node := range nodes {
+		b.WriteString(innerText(node))
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// parseFeed parses an RSS, Atom or JSON Feed document, figuring out which it is from its contents.
+func parseFeed(body []byte) (*Feed, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONFeed(trimmed)
+	}
+	// Find the root element to know what kind of XML feed this is
+	decoder := newFeedDecoder(trimmed)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, errors.New("not a feed: " + err.Error())
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "rss", "RDF":
+			var doc rssDocument
+			err = decoder.DecodeElement(&doc, &start)
+			if err != nil {
+				return nil, err
+			}
+			return doc.feed(), nil
+		case "feed":
+			var doc atomFeed
+			err = decoder.DecodeElement(&doc, &start)
+			if err != nil {
+				return nil, err
+			}
+			return doc.feed(), nil
+		default:
+			return nil, errors.New("not a feed: root element is " + start.Name.Local)
+		}
+	}
+}
+
+// newFeedDecoder creates an XML decoder that's lenient about the mistakes feeds commonly have.
+func newFeedDecoder(body []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	// don't choke on documents that aren't UTF-8
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return decoder
+}
+
+func (doc rssDocument) feed() *Feed {
+	feed := &Feed{
+		Title: strings.TrimSpace(doc.Channel.Title),
+		Link:  rssLinkURL(doc.Channel.Links),
+	}
+	for _, item := range append(doc.Channel.Items, doc.Items...) {
+		published := item.PubDate
+		if len(published) == 0 {
+			published = item.Date
+		}
+		author := item.Author
+		if len(author) == 0 {
+			author = item.Creator
+		}
+		feed.Items = append(feed.Items, FeedItem{
+			GUID:      strings.TrimSpace(item.GUID),
+			Title:     stripHTML(item.Title),
+			Link:      rssLinkURL(item.Links),
+			Summary:   stripHTML(item.Description),
+			Author:    strings.TrimSpace(author),
+			Published: parseFeedDate(published),
+		})
+	}
+	return feed
+}
+
+// rssLinkURL finds the RSS link in a list of link elements,
+// falling back to an Atom alternate link if there isn't one.
+func rssLinkURL(links []rssLink) string {
+	var atomLinks []atomLink
+	for _, link := range links {
+		if link.XMLName.Space == atomNamespace {
+			atomLinks = append(atomLinks, link.atomLink)
+			continue
+		}
+		if text := strings.TrimSpace(link.Text); len(text) > 0 {
+			return text
+		}
+	}
+	return atomLinkHref(atomLinks)
+}
+
+// atomLinkHref finds the alternate link in a list of Atom links.
+func atomLinkHref(links []atomLink) string {
+	for _, link := range links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			return strings.TrimSpace(link.Href)
+		}
+	}
+	return ""
+}
+
+func (doc atomFeed) feed() *Feed {
+	feed := &Feed{
+		Title: stripHTML(doc.Title),
+		Link:  atomLinkHref(doc.Links),
+	}
+	for _, entry := range doc.Entries {
+		summary := entry.Summary
+		if len(summary) == 0 {
+			summary = entry.Content
+		}
+		published := entry.Published
+		if len(published) == 0 {
+			published = entry.Updated
+		}
+		feed.Items = append(feed.Items, FeedItem{
+			GUID:      strings.TrimSpace(entry.ID),
+			Title:     stripHTML(entry.Title),
+			Link:      atomLinkHref(entry.Links),
+			Summary:   stripHTML(summary),
+			Author:    strings.TrimSpace(entry.Author.Name),
+			Published: parseFeedDate(published),
+		})
+	}
+	return feed
+}
+
+func parseJSONFeed(body []byte) (*Feed, error) {
+	var doc jsonFeed
+	err := json.Unmarshal(body, &doc)
+	if err != nil {
+		return nil, errors.New("not a feed: " + err.Error())
+	}
+	feed := &Feed{
+		Title: doc.Title,
+		Link:  doc.HomePageURL,
+	}
+	for _, item := range doc.Items {
+		var guid string
+		switch id := item.ID.(type) {
+		case string:
+			guid = id
+		case float64:
+			// the spec says IDs are strings, but some feeds use numbers
+			guid = strconv.FormatFloat(id, 'f', -1, 64)
+		}
+		summary := item.Summary
+		if len(summary) == 0 {
+			summary = item.ContentText
+		}
+		if len(summary) == 0 {
+			summary = stripHTML(item.ContentHTML)
+		}
+		author := item.Author.Name
+		if len(author) == 0 && len(item.Authors) > 0 {
+			author = item.Authors[0].Name
+		}
+		feed.Items = append(feed.Items, FeedItem{
+			GUID:      guid,
+			Title:     item.Title,
+			Link:      item.URL,
+			Summary:   summary,
+			Author:    author,
+			Published: parseFeedDate(item.DatePublished),
+		})
+	}
+	return feed, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestParseFeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		link     string
+		itemLink string
+		guid     string
+	}{
+		{
+			name: "rss with atom links",
+			body: `<?xml version="1.0"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+<channel>
+	<title>Example</title>
+	<link>https://example.com/</link>
+	<atom:link href="https://example.com/feed.xml" rel="self" type="application/rss+xml"/>
+	<item>
+		<title>First &amp; best</title>
+		<atom:link href="https://example.com/self" rel="self"/>
+		<link>https://example.com/1</link>
+		<guid>1</guid>
+	</item>
+</channel>
+</rss>`,
+			link:     "https://example.com/",
+			itemLink: "https://example.com/1",
+			guid:     "1",
+		},
+		{
+			name: "rss with only an atom link",
+			body: `<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Example</title>
+<atom:link href="https://example.com/feed.xml" rel="self"/><atom:link href="https://example.com/" rel="alternate"/>
+<item><title>x</title><atom:link href="https://example.com/2"/></item></channel></rss>`,
+			link:     "https://example.com/",
+			itemLink: "https://example.com/2",
+		},
+		{
+			name: "rss 1.0",
+			body: `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/">
+<channel><title>Example</title><link>https://example.com/</link></channel>
+<item><title>x</title><link>https://example.com/3</link></item></rdf:RDF>`,
+			link:     "https://example.com/",
+			itemLink: "https://example.com/3",
+		},
+		{
+			name: "atom",
+			body: `<feed xmlns="http://www.w3.org/2005/Atom"><title>Example</title>
+<link rel="self" href="https://example.com/feed"/><link href="https://example.com/"/>
+<entry><id>tag:4</id><title>x</title><link rel="alternate" href="https://example.com/4"/></entry></feed>`,
+			link:     "https://example.com/",
+			itemLink: "https://example.com/4",
+			guid:     "tag:4",
+		},
+	}
+	for _, test := range tests {
+		feed, err := parseFeed([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if feed.Link != test.link {
+			t.Errorf("%s: got feed link %q, want %q", test.name, feed.Link, test.link)
+		}
+		if len(feed.Items) != 1 {
+			t.Errorf("%s: got %d items, want 1", test.name, len(feed.Items))
+			continue
+		}
+		if feed.Items[0].Link != test.itemLink {
+			t.Errorf("%s: got item link %q, want %q", test.name, feed.Items[0].Link, test.itemLink)
+		}
+		if feed.Items[0].GUID != test.guid {
+			t.Errorf("%s: got GUID %q, want %q", test.name, feed.Items[0].GUID, test.guid)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 module gitlab.com/bclindner/valerius/v0.7.1
 
+go 1.13
+
 require (
+	github.com/andybalholm/cascadia v1.2.0
+	github.com/antchfx/xpath v1.1.10
 	github.com/bclindner/iasipgenerator v0.0.0-20181218024440-9e995f4ca2d0
-	github.com/bwmarrin/discordgo v0.19.0
+	github.com/bwmarrin/discordgo v0.27.1
 	github.com/gregjones/httpcache v0.0.0-20190212212710-3befbb6ad0cc
 	github.com/sirupsen/logrus v1.3.0
 	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/crypto v0.0.0-20190211182817-74369b46fc67 // indirect
 	golang.org/x/image v0.0.0-20190209060608-ef4a1470e0dc // indirect
-	golang.org/x/sys v0.0.0-20190214214411-e77772198cdc // indirect
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 )
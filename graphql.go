@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus" // logging suite
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// GraphQLCommand is a RESTCommand that sends a GraphQL query.
+type GraphQLCommand struct {
+	RESTCommand
+}
+
+// GraphQLConfig is the configuration for the GraphQLCommand.
+// Everything but the request body and method works like in RESTConfig:
+// endpoint, headers, auth, the response template, embed and error message.
+// The response template and embed get a GraphQLContext.
+type GraphQLConfig struct {
+	RESTConfig
+	// The GraphQL query document.
+	GraphQLQuery string `json:"graphqlquery"`
+	// File to read the query document from, instead of graphqlquery.
+	GraphQLQueryFile string `json:"graphqlqueryFile"`
+	// Name of the operation to run, if the document has more than one.
+	OperationName string `json:"operationname"`
+	// Variables to send with the query, by name. String values are templates executed
+	// with the MessageContext and sent as strings; other values are sent as-is.
+	Variables map[string]interface{} `json:"variables"`
+	// Variables whose templates render JSON, for variables that aren't strings,
+	// e.g. {"count": "{{.Named.count}}"}.
+	JSONVariables map[string]string `json:"jsonvariables"`
+}
+
+// graphqlRequest renders the bodies of GraphQL requests.
+type graphqlRequest struct {
+	query         string
+	operationName string
+	variables     map[string]interface{}
+	templates     map[string]*template.Template
+	jsontemplates map[string]*template.Template
+}
+
+// GraphQLContext is the data GraphQL response templates get.
+type GraphQLContext struct {
+	// The data object of the response.
+	Data interface{} `json:"data"`
+	// Errors the server sent alongside the data, if it could only get some of it.
+	Errors []GraphQLError `json:"errors"`
+}
+
+// GraphQLError is a single error in a GraphQL response.
+type GraphQLError struct {
+	Message string `json:"message"`
+	// Path of the field in the data that the error is about, if any.
+	Path []interface{} `json:"path"`
+	// Extra information about the error, like an error code. What's in here depends on the server.
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+// NewGraphQLCommand generates a new GraphQLCommand.
+func NewGraphQLCommand(config BaseCommand) (command GraphQLCommand, err error) {
+	var options GraphQLConfig
+	err = json.Unmarshal(config.Options, &options)
+	if err != nil {
+		return command, err
+	}
+	// Ensure only one of GraphQLQuery and GraphQLQueryFile is set
+	if len(options.GraphQLQuery) > 0 && len(options.GraphQLQueryFile) > 0 {
+		return command, errors.New("Can only have one of graphqlquery and graphqlqueryFile")
+	}
+	query := options.GraphQLQuery
+	if len(options.GraphQLQueryFile) > 0 {
+		querybytes, err := ioutil.ReadFile(options.GraphQLQueryFile)
+		if err != nil {
+			return command, errors.New("Error reading query file: " + err.Error())
+		}
+		query = string(querybytes)
+	}
+	if len(strings.TrimSpace(query)) == 0 {
+		return command, errors.New("graphqlquery must be set")
+	}
+	// The body is the query, so these don't make sense
+	if len(options.Steps) > 0 {
+		return command, errors.New("GraphQL commands cannot have steps")
+	}
+	if len(options.Body) > 0 || len(options.Form) > 0 {
+		return command, errors.New("GraphQL commands cannot have a body or form; use variables instead")
+	}
+	if len(options.Method) == 0 {
+		options.Method = "POST"
+	}
+	options.ResponseFormat = responseFormatGraphQL
+	// Compile the variables
+	request := &graphqlRequest{
+		query:         query,
+		operationName: options.OperationName,
+		variables:     make(map[string]interface{}),
+		templates:     make(map[string]*template.Template),
+	}
+	for name, value := range options.Variables {
+		text, ok := value.(string)
+		if !ok {
+			request.variables[name] = value
+			continue
+		}
+		request.templates[name], err = newTemplate(config.Name+" variable "+name, text)
+		if err != nil {
+			return command, errors.New("Failed to compile variable template " + name + ": " + err.Error())
+		}
+	}
+	request.jsontemplates, err = compileTemplateMap(config.Name+" variable", options.JSONVariables)
+	if err != nil {
+		return command, err
+	}
+	// Build the REST command, and have it send the query
+	command.RESTCommand, err = newRESTCommand(config, options.RESTConfig)
+	if err != nil {
+		return command, err
+	}
+	command.steps[0].request.renderBody = request.render
+	command.steps[0].request.parseError = graphqlBodyError
+	return command, nil
+}
+
+// render renders the JSON body of a request for a message.
+func (g *graphqlRequest) render(ctx MessageContext) ([]byte, error) {
+	variables := make(map[string]interface{}, len(g.variables)+len(g.templates)+len(g.jsontemplates))
+	for name, value := range g.variables {
+		variables[name] = value
+	}
+	for name, tmpl := range g.templates {
+		value, err := executeTemplate(tmpl, ctx)
+		if err != nil {
+			return nil, errors.New("could not execute variable template " + name + ": " + err.Error())
+		}
+		variables[name] = value
+	}
+	for name, tmpl := range g.jsontemplates {
+		value, err := executeTemplate(tmpl, ctx)
+		if err != nil {
+			return nil, errors.New("could not execute variable template " + name + ": " + err.Error())
+		}
+		var decoded interface{}
+		err = json.Unmarshal([]byte(value), &decoded)
+		if err != nil {
+			return nil, errors.New("variable " + name + " did not render valid JSON: " + err.Error())
+		}
+		variables[name] = decoded
+	}
+	body := map[string]interface{}{
+		"query":     g.query,
+		"variables": variables,
+	}
+	if len(g.operationName) > 0 {
+		body["operationName"] = g.operationName
+	}
+	return json.Marshal(body)
+}
+
+// parseGraphQL parses a GraphQL response into a GraphQLContext.
+// If the response has errors and no data, they're returned as an error;
+// errors alongside partial data are logged, and passed on to templates.
+func parseGraphQL(body []byte) (interface{}, error) {
+	var resp GraphQLContext
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Errors) == 0 {
+		return resp, nil
+	}
+	if resp.Data == nil {
+		return nil, graphqlErrors(resp.Errors)
+	}
+	log.WithField("errors", graphqlErrors(resp.Errors).Error()).Warn("GraphQL response has partial data")
+	return resp, nil
+}
+
+// graphqlErrors combines the errors of a GraphQL response into one.
+func graphqlErrors(errs []GraphQLError) error {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	return errors.New("GraphQL errors: " + strings.Join(messages, "; "))
+}
+
+// graphqlBodyError gets the GraphQL errors out of the body of a failed response.
+// Servers often send errors with a 4xx or 5xx status, and the status alone
+// doesn't say what went wrong.
+func graphqlBodyError(body []byte) error {
+	var resp GraphQLContext
+	if json.Unmarshal(body, &resp) != nil || len(resp.Errors) == 0 {
+		return nil
+	}
+	return graphqlErrors(resp.Errors)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/bwmarrin/discordgo"  // for running the bot
 	log "github.com/sirupsen/logrus" // logging suite
+	"time"
 )
 
 // Command is an interface for commands that can be handled by the MessageHandler.
@@ -23,6 +24,55 @@ type Command interface {
 	Check(guildID string, channelID string, userID string) bool
 }
 
+// service is implemented by commands that do things in the background,
+// rather than (or as well as) in response to messages.
+type service interface {
+	// Starts the service. This must not block.
+	start(bot *discordgo.Session)
+	// Stops the service, waiting for anything it's in the middle of.
+	stop()
+}
+
+// background runs a service's goroutine, and stops it.
+type background struct {
+	// Closed to stop the goroutine.
+	stopping chan struct{}
+	// Closed once the goroutine has stopped.
+	done chan struct{}
+}
+
+// run starts a goroutine, which should return once stopping is closed.
+func (b *background) run(task func(stopping <-chan struct{})) {
+	b.stopping = make(chan struct{})
+	b.done = make(chan struct{})
+	go func() {
+		defer close(b.done)
+		task(b.stopping)
+	}()
+}
+
+// poll starts a goroutine that calls poll straight away, then on every interval.
+func (b *background) poll(interval time.Duration, poll func()) {
+	b.run(func(stopping <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			poll()
+			select {
+			case <-stopping:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// stop stops the goroutine, waiting for whatever it's in the middle of to finish.
+func (b *background) stop() {
+	close(b.stopping)
+	<-b.done
+}
+
 // Checks if a list contains something.
 func listContains(list []string, id string) bool {
 	for _, listid := range list {
@@ -105,13 +155,22 @@ func (b BaseCommand) Check(guildID, channelID, userID string) bool {
 type Handler struct {
 	// List of commands to test.
 	commands []Command
+	// Commands by name, for component actions that run other commands.
+	named map[string]Command
+	// Component actions, by custom ID.
+	components map[string]componentRoute
+	// Commands that run in the background.
+	services []service
 	// Command to disconnect the handler from the bot.
 	DestroySelf func()
 }
 
 // NewHandler creates a new handler and binds it to a Session.
 func NewHandler(bot *discordgo.Session, commands []BaseCommand) (*Handler, error) {
-	handler := Handler{}
+	handler := Handler{
+		named:      make(map[string]Command),
+		components: make(map[string]componentRoute),
+	}
 	// set variables for use in the loop
 	var (
 		err error
@@ -126,6 +185,16 @@ func NewHandler(bot *discordgo.Session, commands []BaseCommand) (*Handler, error
 			cmd, err = NewIASIPCommand(config)
 		case "rest":
 			cmd, err = NewRESTCommand(config)
+		case "graphql":
+			cmd, err = NewGraphQLCommand(config)
+		case "restwatch":
+			cmd, err = NewRESTWatchCommand(config)
+		case "feed":
+			cmd, err = NewFeedCommand(config)
+		case "webhook":
+			cmd, err = NewWebhookCommand(config)
+		case "schedule":
+			cmd, err = NewScheduleCommand(config)
 		case "reload":
 			cmd, err = NewReloadCommand(config)
 		default:
@@ -138,10 +207,56 @@ func NewHandler(bot *discordgo.Session, commands []BaseCommand) (*Handler, error
 		// add the command
 		handler.Add(cmd)
 	}
+	// webhooks need the webhook server, and a path of their own
+	webhookPaths := make(map[string]string)
+	for _, cmd := range handler.commands {
+		webhook, ok := cmd.(*WebhookCommand)
+		if !ok {
+			continue
+		}
+		if len(config.WebhookListen) == 0 {
+			return &handler, errors.New("Error with command " + webhook.Name + ": webhook commands need webhookListen to be set in the bot config")
+		}
+		if other, taken := webhookPaths[webhook.Path]; taken {
+			return &handler, errors.New("Error with command " + webhook.Name + ": path " + webhook.Path + " is already used by " + other)
+		}
+		webhookPaths[webhook.Path] = webhook.Name
+	}
+	// route components now that every command they may refer to exists
+	for _, cmd := range handler.commands {
+		if owner, ok := cmd.(componentOwner); ok {
+			err = handler.addComponentRoutes(cmd, owner.getComponents())
+			if err != nil {
+				return &handler, errors.New("Error with command " + cmd.GetName() + ": " + err.Error())
+			}
+		}
+	}
+	// start the webhook server last, since it can't be undone if something else fails
+	if len(webhookPaths) > 0 {
+		err = webhooks.listen(config.WebhookListen)
+		if err != nil {
+			return &handler, errors.New("Could not start webhook server: " + err.Error())
+		}
+	}
 	// log how many commands we parsed
 	log.Info("Parsed ", len(handler.commands), " commands")
-	// register self with the bot, and get the function necessary to detach from bot
-	handler.DestroySelf = bot.AddHandler(handler.Handle)
+	// start background services, now that nothing can fail
+	for _, cmd := range handler.commands {
+		if svc, ok := cmd.(service); ok {
+			svc.start(bot)
+			handler.services = append(handler.services, svc)
+		}
+	}
+	// register self with the bot, and get the functions necessary to detach from bot
+	removeMessageHandler := bot.AddHandler(handler.Handle)
+	removeInteractionHandler := bot.AddHandler(handler.HandleInteraction)
+	handler.DestroySelf = func() {
+		removeMessageHandler()
+		removeInteractionHandler()
+		for _, svc := range handler.services {
+			svc.stop()
+		}
+	}
 	return &handler, nil
 }
 
@@ -174,6 +289,7 @@ func (c *Handler) Handle(bot *discordgo.Session, evt *discordgo.MessageCreate) {
 					"guildID":   evt.Message.GuildID,
 					"channelID": evt.Message.ChannelID,
 				}).Info("Command fired")
+				events.emit(commandEvent(eventCommandFired, cmd, evt))
 				// and run the command
 				err := cmd.Run(bot, evt)
 				if err != nil {
@@ -188,6 +304,9 @@ func (c *Handler) Handle(bot *discordgo.Session, evt *discordgo.MessageCreate) {
 						"username":  author.Username + "#" + author.Discriminator,
 						"error":     err,
 					}).Error("Command failed")
+					failed := commandEvent(eventCommandFailed, cmd, evt)
+					failed.Error = err.Error()
+					events.emit(failed)
 				}
 			}
 		}(cmd)
@@ -197,4 +316,5 @@ func (c *Handler) Handle(bot *discordgo.Session, evt *discordgo.MessageCreate) {
 // Add commands to the handler, validating whitelists/blacklists as well.
 func (c *Handler) Add(cmd Command) {
 	c.commands = append(c.commands, cmd)
+	c.named[cmd.GetName()] = cmd
 }
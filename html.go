@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/xpath"
+	"golang.org/x/net/html"
+	"strconv"
+	"strings"
+)
+
+// htmlSelector extracts strings from an HTML document.
+type htmlSelector interface {
+	extract(doc *html.Node) []string
+}
+
+// newHTMLSelector compiles a selector from the config.
+// Selectors starting with "xpath:" are XPath expressions; anything else is a CSS selector,
+// optionally followed by "@attribute" to extract an attribute instead of the text, e.g. "a.next@href".
+func newHTMLSelector(selector string) (htmlSelector, error) {
+	if strings.HasPrefix(selector, "xpath:") {
+		expr, err := xpath.Compile(strings.TrimPrefix(selector, "xpath:"))
+		if err != nil {
+			return nil, err
+		}
+		return xpathSelector{expr: expr}, nil
+	}
+	selector, attr, err := splitSelectorAttr(selector)
+	if err != nil {
+		return nil, err
+	}
+	sel, err := cascadia.Compile(selector)
+	if err != nil {
+		return nil, err
+	}
+	return cssSelector{selector: sel, attr: attr}, nil
+}
+
+// splitSelectorAttr splits the trailing "@attribute" off a CSS selector.
+// Only an @ outside of attribute selectors and quotes counts, so selectors
+// like a[href*="@"] are left alone.
+func splitSelectorAttr(selector string) (css, attr string, err error) {
+	at := -1
+	depth := 0
+	var quote rune
+	for i, c := range selector {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '@' && depth == 0:
+			at = i
+		}
+	}
+	if at < 0 {
+		return selector, "", nil
+	}
+	css, attr = selector[:at], selector[at+1:]
+	if len(attr) == 0 {
+		return "", "", errors.New("missing attribute name after @")
+	}
+	if strings.ContainsAny(attr, " \t\n[]()>+~,.#:\"'") {
+		return "", "", errors.New("invalid attribute name " + attr + " after @")
+	}
+	return css, attr, nil
+}
+
+// cssSelector extracts the text or an attribute of every element matching a CSS selector.
+type cssSelector struct {
+	selector cascadia.Selector
+	attr     string
+}
+
+func (c cssSelector) extract(doc *html.Node) (values []string) {
+	for _, node := range c.selector.MatchAll(doc) {
+		if len(c.attr) == 0 {
+			values = append(values, strings.TrimSpace(innerText(node)))
+			continue
+		}
+		for _, attr := range node.Attr {
+			if attr.Key == c.attr {
+				values = append(values, attr.Val)
+				break
+			}
+		}
+	}
+	return values
+}
+
+// xpathSelector extracts the values of the nodes matching an XPath expression.
+type xpathSelector struct {
+	expr *xpath.Expr
+}
+
+func (x xpathSelector) extract(doc *html.Node) (values []string) {
+	switch result := x.expr.Evaluate(newHTMLNavigator(doc)).(type) {
+	case *xpath.NodeIterator:
+		for result.MoveNext() {
+			values = append(values, strings.TrimSpace(result.Current().Value()))
+		}
+	case string:
+		values = append(values, result)
+	case float64:
+		values = append(values, strconv.FormatFloat(result, 'f', -1, 64))
+	case bool:
+		values = append(values, strconv.FormatBool(result))
+	}
+	return values
+}
+
+// innerText gets all the text inside a node.
+func innerText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	var b strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.CommentNode {
+			b.WriteString(innerText(child))
+		}
+	}
+	return b.String()
+}
+
+// htmlNavigator lets the xpath package walk an HTML document.
+type htmlNavigator struct {
+	root, curr *html.Node
+	// Index of the current attribute of curr, or -1 if we're on the node itself.
+	attr int
+}
+
+func newHTMLNavigator(root *html.Node) *htmlNavigator {
+	return &htmlNavigator{root: root, curr: root, attr: -1}
+}
+
+func (h *htmlNavigator) NodeType() xpath.NodeType {
+	switch h.curr.Type {
+	case html.CommentNode:
+		return xpath.CommentNode
+	case html.TextNode:
+		return xpath.TextNode
+	case html.ElementNode:
+		if h.attr != -1 {
+			return xpath.AttributeNode
+		}
+		return xpath.ElementNode
+	}
+	// documents and doctypes
+	return xpath.RootNode
+}
+
+func (h *htmlNavigator) LocalName() string {
+	if h.attr != -1 {
+		return h.curr.Attr[h.attr].Key
+	}
+	return h.curr.Data
+}
+
+func (h *htmlNavigator) Prefix() string {
+	return ""
+}
+
+func (h *htmlNavigator) Value() string {
+	switch h.curr.Type {
+	case html.CommentNode, html.TextNode:
+		return h.curr.Data
+	case html.ElementNode:
+		if h.attr != -1 {
+			return h.curr.Attr[h.attr].Val
+		}
+		return innerText(h.curr)
+	}
+	return ""
+}
+
+func (h *htmlNavigator) Copy() xpath.NodeNavigator {
+	n := *h
+	return &n
+}
+
+func (h *htmlNavigator) MoveToRoot() {
+	h.curr = h.root
+	h.attr = -1
+}
+
+func (h *htmlNavigator) MoveToParent() bool {
+	if h.attr != -1 {
+		h.attr = -1
+		return true
+	}
+	if h.curr.Parent != nil {
+		h.curr = h.curr.Parent
+		return true
+	}
+	return false
+}
+
+func (h *htmlNavigator) MoveToNextAttribute() bool {
+	if h.attr >= len(h.curr.Attr)-1 {
+		return false
+	}
+	h.attr++
+	return true
+}
+
+func (h *htmlNavigator) MoveToChild() bool {
+	if h.attr != -1 || h.curr.FirstChild == nil {
+		return false
+	}
+	h.curr = h.curr.FirstChild
+	return true
+}
+
+func (h *htmlNavigator) MoveToFirst() bool {
+	if h.attr != -1 || h.curr.PrevSibling == nil {
+		return false
+	}
+	for h.curr.PrevSibling != nil {
+		h.curr = h.curr.PrevSibling
+	}
+	return true
+}
+
+func (h *htmlNavigator) MoveToNext() bool {
+	if h.attr != -1 || h.curr.NextSibling == nil {
+		return false
+	}
+	h.curr = h.curr.NextSibling
+	return true
+}
+
+func (h *htmlNavigator) MoveToPrevious() bool {
+	if h.attr != -1 || h.curr.PrevSibling == nil {
+		return false
+	}
+	h.curr = h.curr.PrevSibling
+	return true
+}
+
+func (h *htmlNavigator) MoveTo(other xpath.NodeNavigator) bool {
+	node, ok := other.(*htmlNavigator)
+	if !ok || node.root != h.root {
+		return false
+	}
+	h.curr = node.curr
+	h.attr = node.attr
+	return true
+}
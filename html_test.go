@@ -0,0 +1,40 @@
+package main
+
+import (
+	"golang.org/x/net/html"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTMLSelector(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<p><a href="mailto:me@example.com">mail</a> <a href="/next" class="next">next</a></p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"a.next", []string{"next"}},
+		{"a.next@href", []string{"/next"}},
+		{`a[href*="@"]`, []string{"mail"}},
+		{`a[href*='@']@href`, []string{"mailto:me@example.com"}},
+		{"xpath://a[@class='next']/@href", []string{"/next"}},
+	}
+	for _, test := range tests {
+		sel, err := newHTMLSelector(test.selector)
+		if err != nil {
+			t.Errorf("%s: %s", test.selector, err)
+			continue
+		}
+		if got := sel.extract(doc); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.selector, got, test.want)
+		}
+	}
+	for _, selector := range []string{"a@", "a@href.x"} {
+		if _, err := newHTMLSelector(selector); err == nil {
+			t.Errorf("%s: expected an error", selector)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// TLS versions, by config name.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// HTTPProfileConfig configures how outbound HTTP connections are made:
+// through a proxy, trusting extra CAs, and with a client certificate.
+// Profiles can be defined in the bot config's httpProfiles and referenced by name,
+// or set inline on a command.
+type HTTPProfileConfig struct {
+	// URL of the proxy to send requests through, e.g. "http://proxy.corp:3128".
+	// If unset (or set to "env"), the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+	Proxy string `json:"proxy"`
+	// PEM files of CA certificates to trust, on top of the system's.
+	CAFiles []string `json:"caFiles"`
+	// PEM files of a client certificate and its key, for mutual TLS.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// Minimum TLS version to accept: "1.0", "1.1", "1.2" (the default) or "1.3".
+	MinTLSVersion string `json:"minTLSVersion"`
+}
+
+// resolveHTTPProfile picks the HTTP profile to use: the inline one if set,
+// otherwise the named one, otherwise the bot's default profile, if it has one.
+// A nil profile means connections use the environment's proxy and the default TLS settings.
+func resolveHTTPProfile(name string, inline *HTTPProfileConfig) (*HTTPProfileConfig, error) {
+	if inline != nil {
+		if len(name) > 0 {
+			return nil, errors.New("Can only have one of httpprofile and http")
+		}
+		return inline, nil
+	}
+	if len(name) == 0 {
+		name = config.HTTPProfile
+		if len(name) == 0 {
+			return nil, nil
+		}
+	}
+	profile, ok := config.HTTPProfiles[name]
+	if !ok {
+		return nil, errors.New("HTTP profile " + name + " does not exist")
+	}
+	return &profile, nil
+}
+
+// apply configures a transport with the profile.
+func (p *HTTPProfileConfig) apply(transport *http.Transport) error {
+	// Set up the proxy
+	switch p.Proxy {
+	case "":
+	case "env":
+		transport.Proxy = http.ProxyFromEnvironment
+	default:
+		proxy, err := url.Parse(p.Proxy)
+		if err != nil || len(proxy.Host) == 0 {
+			return errors.New("Invalid proxy " + p.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	// Set up TLS
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(p.MinTLSVersion) > 0 {
+		version, ok := tlsVersions[p.MinTLSVersion]
+		if !ok {
+			return errors.New("Invalid minTLSVersion " + p.MinTLSVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(p.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range p.CAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return errors.New("Error reading CA file: " + err.Error())
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return errors.New("No certificates found in CA file " + file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(p.CertFile) > 0 || len(p.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return errors.New("Error loading client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/bclindner/iasipgenerator/iasipgen"
 	"github.com/bwmarrin/discordgo"
 	"image/jpeg"
@@ -62,18 +63,32 @@ func (i IASIPCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate)
 
 // Run generates an IASIP title card and sends it as a file to the channel.
 func (i IASIPCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) (err error) {
-	msgstring := i.TriggerRegex.FindStringSubmatch(evt.Message.Content)[1]
-	img, err := iasipgen.Generate(msgstring)
+	match := i.TriggerRegex.FindStringSubmatch(evt.Message.Content)
+	if len(match) < 2 {
+		return errors.New("message doesn't match the trigger")
+	}
+	msgstring := match[1]
+	buf, err := renderTitleCard(msgstring, i.ImageQuality)
 	if err != nil {
 		return err
 	}
+	bot.ChannelFileSend(evt.Message.ChannelID, "iasip.jpg", buf)
+	return nil
+}
+
+// renderTitleCard generates a title card as a JPEG.
+// The font has to have been loaded already.
+func renderTitleCard(text string, quality int) (*bytes.Buffer, error) {
+	img, err := iasipgen.Generate(text)
+	if err != nil {
+		return nil, err
+	}
 	buf := new(bytes.Buffer)
 	err = jpeg.Encode(buf, img, &jpeg.Options{
-		Quality: i.ImageQuality,
+		Quality: quality,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	bot.ChannelFileSend(evt.Message.ChannelID, "iasip.jpg", buf)
-	return nil
+	return buf, nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Trigger modes for the PingPongCommand's "trigger" and "triggers".
+const (
+	// The whole message must match the trigger. This is the default.
+	triggerModeExact = "exact"
+	// The trigger must appear somewhere in the message.
+	triggerModeContains = "contains"
+	// The message must start with the trigger.
+	triggerModeStartsWith = "startswith"
+	// The trigger must appear in the message as a whole word (or words).
+	triggerModeWord = "word"
+)
+
+// Matches custom Discord emoji, e.g. <:valerius:123456789>.
+var customEmojiRegex = regexp.MustCompile(`<a?:\w+:\d+>`)
+
+// normalizeText strips custom emoji, punctuation, symbols (including unicode emoji)
+// and extra whitespace from a string, and lowercases it,
+// so "Hello,   World!! :)" becomes "hello world".
+func normalizeText(text string) string {
+	text = customEmojiRegex.ReplaceAllString(text, " ")
+	var b strings.Builder
+	space := false
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// isWordRune reports whether a rune is part of a word, for whole-word matching.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// containsWord checks if needle appears in haystack with no word characters on either side.
+func containsWord(haystack, needle string) bool {
+	if len(needle) == 0 {
+		return false
+	}
+	for offset := 0; offset < len(haystack); {
+		i := strings.Index(haystack[offset:], needle)
+		if i < 0 {
+			return false
+		}
+		start := offset + i
+		end := start + len(needle)
+		before, _ := utf8.DecodeLastRuneInString(haystack[:start])
+		after, _ := utf8.DecodeRuneInString(haystack[end:])
+		if (start == 0 || !isWordRune(before)) && (end == len(haystack) || !isWordRune(after)) {
+			return true
+		}
+		// try again from the next character
+		_, size := utf8.DecodeRuneInString(haystack[start:])
+		offset = start + size
+	}
+	return false
+}
+
+// textMatcher matches messages against a list of trigger strings.
+type textMatcher struct {
+	mode       string
+	ignoreCase bool
+	normalize  bool
+	// Triggers, already lowercased or normalized as necessary.
+	triggers []string
+}
+
+// newTextMatcher creates a textMatcher, preparing the triggers for the mode.
+func newTextMatcher(mode string, ignoreCase, normalize bool, triggers []string) (*textMatcher, error) {
+	switch mode {
+	case "":
+		mode = triggerModeExact
+	case triggerModeExact, triggerModeContains, triggerModeStartsWith, triggerModeWord:
+	default:
+		return nil, errors.New("Invalid trigger mode " + mode)
+	}
+	m := &textMatcher{
+		mode:       mode,
+		ignoreCase: ignoreCase,
+		normalize:  normalize,
+	}
+	for _, trigger := range triggers {
+		prepared := m.prepare(trigger)
+		// an empty trigger would match every message (or every empty one)
+		if len(prepared) == 0 {
+			if normalize {
+				return nil, errors.New("Trigger " + strconv.Quote(trigger) + " is empty once normalized; turn off normalize to match punctuation and emoji")
+			}
+			return nil, errors.New("Triggers cannot be empty")
+		}
+		m.triggers = append(m.triggers, prepared)
+	}
+	return m, nil
+}
+
+// prepare lowercases or normalizes text, depending on the matcher's settings.
+func (m *textMatcher) prepare(text string) string {
+	if m.normalize {
+		return normalizeText(text)
+	}
+	if m.ignoreCase {
+		return strings.ToLower(text)
+	}
+	return text
+}
+
+// match checks if a message matches any of the triggers.
+func (m *textMatcher) match(content string) bool {
+	content = m.prepare(content)
+	for _, trigger := range m.triggers {
+		var matched bool
+		switch m.mode {
+		case triggerModeExact:
+			matched = content == trigger
+		case triggerModeContains:
+			matched = strings.Contains(content, trigger)
+		case triggerModeStartsWith:
+			matched = strings.HasPrefix(content, trigger)
+		case triggerModeWord:
+			matched = containsWord(content, trigger)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
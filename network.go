@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus" // logging suite
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defaults for the network policy.
+const (
+	defaultMaxRedirects = 5
+	defaultMaxBodySize  = 10 << 20
+)
+
+// NetworkPolicyConfig restricts what outbound HTTP requests the bot can make.
+// It applies to every request the bot makes on behalf of commands.
+// Requests through a proxy are only checked as well as they can be from here: the proxy
+// resolves hostnames itself, so it could get a different (private) address than the bot did.
+// If that matters, block private addresses on the proxy too.
+type NetworkPolicyConfig struct {
+	// If set, only these hosts can be requested. "*.example.com" allows any subdomain of example.com.
+	AllowedHosts []string `json:"allowedHosts"`
+	// IP ranges that can be connected to even though they're private, e.g. "10.1.2.0/24".
+	AllowedCIDRs []string `json:"allowedCIDRs"`
+	// Allow connecting to private, loopback and link-local addresses.
+	// This is off by default, so commands can't be used to poke at internal services.
+	AllowPrivate bool `json:"allowPrivate"`
+	// Maximum number of redirects to follow. Defaults to 5; set to -1 to follow none,
+	// so commands get the redirect response itself.
+	MaxRedirects int `json:"maxRedirects"`
+	// Maximum size of a response body in bytes. Defaults to 10MB.
+	MaxBodySize int64 `json:"maxBodySize"`
+	// Parsed AllowedCIDRs.
+	allowedNets []*net.IPNet
+}
+
+// Address ranges that are blocked unless allowPrivate is set.
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local (including cloud metadata services)
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+	} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+// parse validates the policy, parsing the allowed CIDRs.
+func (p *NetworkPolicyConfig) parse() error {
+	p.allowedNets = nil
+	for _, cidr := range p.AllowedCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("Invalid allowed CIDR " + cidr + ": " + err.Error())
+		}
+		p.allowedNets = append(p.allowedNets, ipnet)
+	}
+	return nil
+}
+
+// securityEvent logs a blocked request.
+func securityEvent(fields log.Fields, reason string) {
+	fields["security"] = true
+	fields["reason"] = reason
+	log.WithFields(fields).Warn("Blocked outbound request")
+}
+
+// checkHost checks a hostname against the allowed hosts.
+func (p NetworkPolicyConfig) checkHost(host string) error {
+	if len(p.AllowedHosts) == 0 {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+	securityEvent(log.Fields{"host": host}, "host not allowed")
+	return errors.New("host " + host + " is not allowed by the network policy")
+}
+
+// checkIP checks an address we're about to connect to.
+func (p NetworkPolicyConfig) checkIP(ip net.IP) error {
+	for _, ipnet := range p.allowedNets {
+		if ipnet.Contains(ip) {
+			return nil
+		}
+	}
+	if p.AllowPrivate {
+		return nil
+	}
+	blocked := ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			blocked = true
+		}
+	}
+	if blocked {
+		securityEvent(log.Fields{"ip": ip.String()}, "private address")
+		return errors.New("address " + ip.String() + " is not allowed by the network policy")
+	}
+	return nil
+}
+
+// checkResolved resolves a hostname and checks every address it resolves to.
+func (p NetworkPolicyConfig) checkResolved(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		err = p.checkIP(ip)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialControl checks every connection's address after DNS resolution,
+// so hostnames that resolve to internal addresses are caught too.
+func (p NetworkPolicyConfig) dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("could not parse address " + address)
+	}
+	return p.checkIP(ip)
+}
+
+// policyTransport enforces the host allowlist and body size limit on requests.
+type policyTransport struct {
+	base   http.RoundTripper
+	policy NetworkPolicyConfig
+	// The proxy function of the base transport, if it uses a proxy.
+	proxy func(*http.Request) (*url.URL, error)
+}
+
+func (t policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.policy.checkHost(req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	// Connections through a proxy don't go to the target's address, so check that up front.
+	// This is best-effort: the proxy does its own DNS lookup, which a hostile DNS server
+	// can answer differently (see NetworkPolicyConfig).
+	if t.proxy != nil {
+		if proxy, _ := t.proxy(req); proxy != nil {
+			err = t.policy.checkResolved(req.URL.Hostname())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	limit := t.policy.MaxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodySize
+	}
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		securityEvent(log.Fields{"endpoint": req.URL.String(), "size": resp.ContentLength}, "response too large")
+		return nil, errors.New("response is larger than the limit of " + strconv.FormatInt(limit, 10) + " bytes")
+	}
+	resp.Body = &limitedBody{body: resp.Body, remaining: limit, endpoint: req.URL.String()}
+	return resp, nil
+}
+
+// limitedBody fails reads once more than a set number of bytes have been read,
+// rather than silently truncating the body.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	endpoint  string
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errors.New("response body is too large")
+	}
+	// read one byte past the limit, so we can tell if the body is over it
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.body.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		securityEvent(log.Fields{"endpoint": l.endpoint}, "response too large")
+		return n, errors.New("response body is too large")
+	}
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.body.Close()
+}
+
+// newHTTPTransport creates a transport that enforces the bot's network policy,
+// set up with an HTTP profile (which can be nil).
+// All outbound HTTP made for commands should go through one of these.
+func newHTTPTransport(profile *HTTPProfileConfig) (http.RoundTripper, error) {
+	policy := config.Network
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	checkedDialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   policy.dialControl,
+	}
+	transport := &http.Transport{
+		// like http.DefaultTransport, unless the profile sets a proxy
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if profile != nil {
+		err := profile.apply(transport)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The proxy is configured by whoever runs the bot, so it's trusted even if it's on
+	// a private address. Requests through it are checked by policyTransport instead.
+	proxies := proxyAddresses(transport.Proxy)
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if proxies[address] {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return checkedDialer.DialContext(ctx, network, address)
+	}
+	return policyTransport{base: transport, policy: policy, proxy: transport.Proxy}, nil
+}
+
+// proxyAddresses finds the addresses a transport's proxy function sends requests to.
+func proxyAddresses(proxy func(*http.Request) (*url.URL, error)) map[string]bool {
+	addresses := make(map[string]bool)
+	if proxy == nil {
+		return addresses
+	}
+	for _, target := range []string{"http://example.com", "https://example.com"} {
+		req, _ := http.NewRequest("GET", target, nil)
+		u, err := proxy(req)
+		if err != nil || u == nil {
+			continue
+		}
+		port := u.Port()
+		if len(port) == 0 {
+			port = defaultPorts[u.Scheme]
+		}
+		addresses[net.JoinHostPort(u.Hostname(), port)] = true
+	}
+	return addresses
+}
+
+// Default ports of proxy URL schemes.
+var defaultPorts = map[string]string{
+	"http":   "80",
+	"https":  "443",
+	"socks5": "1080",
+}
+
+// redirectChecker returns a CheckRedirect function that limits how many redirects the client follows.
+func redirectChecker(max int) func(req *http.Request, via []*http.Request) error {
+	if max == 0 {
+		max = defaultMaxRedirects
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		if max < 0 {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > max {
+			securityEvent(log.Fields{"endpoint": req.URL.String(), "redirects": len(via)}, "too many redirects")
+			return errors.New("stopped after " + strconv.Itoa(len(via)) + " redirects")
+		}
+		return nil
+	}
+}
+
+// newHTTPClient creates a client that enforces the bot's network policy.
+// Like the transport, it takes the policy from the bot config when it's created,
+// so requests never read the config while a reload is replacing it.
+func newHTTPClient(transport http.RoundTripper, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: redirectChecker(config.Network.MaxRedirects),
+		Timeout:       timeout,
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Response modes for the PingPongCommand.
+const (
+	// Picks a response at random every time, optionally weighted.
+	responseModeRandom = "random"
+	// Goes through all responses in a random order before repeating any of them,
+	// separately for each channel.
+	responseModeShuffle = "shuffle"
+)
+
+// responsePicker picks which of a list of responses to send.
+type responsePicker interface {
+	// Returns the index of the response to send in the given channel.
+	pick(channelID string) int
+}
+
+// weightedPicker picks responses at random, weighted by the configured weights.
+type weightedPicker struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+	// Running total of the weights, used to binary search a random number into a response.
+	cumulative []float64
+}
+
+// newWeightedPicker creates a weightedPicker for n responses.
+// If weights is empty, all responses are equally likely.
+func newWeightedPicker(n int, weights []float64) (*weightedPicker, error) {
+	if len(weights) > 0 && len(weights) != n {
+		return nil, errors.New("Number of weights must match the number of responses")
+	}
+	picker := &weightedPicker{
+		rng: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	total := 0.0
+	for i := 0; i < n; i++ {
+		weight := 1.0
+		if len(weights) > 0 {
+			weight = weights[i]
+		}
+		if weight < 0 {
+			return nil, errors.New("Weights cannot be negative")
+		}
+		total += weight
+		picker.cumulative = append(picker.cumulative, total)
+	}
+	if total <= 0 {
+		return nil, errors.New("At least one weight must be positive")
+	}
+	return picker, nil
+}
+
+func (w *weightedPicker) pick(channelID string) int {
+	w.mu.Lock()
+	r := w.rng.Float64() * w.cumulative[len(w.cumulative)-1]
+	w.mu.Unlock()
+	// find the first response whose running total is past r
+	lo, hi := 0, len(w.cumulative)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if w.cumulative[mid] > r {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+// shufflePicker deals responses out of a shuffled "bag" per channel,
+// only refilling the bag once every response has been used.
+type shufflePicker struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+	n   int
+	// Remaining responses for each channel.
+	bags map[string][]int
+	// Last response sent to each channel, so a refilled bag doesn't start with a repeat.
+	last map[string]int
+}
+
+func (s *shufflePicker) pick(channelID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bag := s.bags[channelID]
+	if len(bag) == 0 {
+		bag = s.rng.Perm(s.n)
+		// don't repeat the last response of the previous bag
+		if last, ok := s.last[channelID]; ok && s.n > 1 && bag[len(bag)-1] == last {
+			bag[0], bag[len(bag)-1] = bag[len(bag)-1], bag[0]
+		}
+	}
+	// deal from the end of the bag
+	i := bag[len(bag)-1]
+	s.bags[channelID] = bag[:len(bag)-1]
+	s.last[channelID] = i
+	return i
+}
+
+// Shuffle pickers are kept here between reloads, by command name,
+// so reloading doesn't reset every channel's bag.
+var (
+	shufflePickersMu sync.Mutex
+	shufflePickers   = make(map[string]shufflePickerEntry)
+)
+
+type shufflePickerEntry struct {
+	// Hash of the response list the picker was made for.
+	signature string
+	picker    *shufflePicker
+}
+
+// getShufflePicker gets the shuffle picker for a command, reusing the previous
+// one if the command's responses haven't changed since it was created.
+func getShufflePicker(name string, responses []string) *shufflePicker {
+	responsesJSON, _ := json.Marshal(responses)
+	hash := sha1.Sum(responsesJSON)
+	signature := hex.EncodeToString(hash[:])
+	shufflePickersMu.Lock()
+	defer shufflePickersMu.Unlock()
+	if entry, ok := shufflePickers[name]; ok && entry.signature == signature {
+		return entry.picker
+	}
+	picker := &shufflePicker{
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		n:    len(responses),
+		bags: make(map[string][]int),
+		last: make(map[string]int),
+	}
+	shufflePickers[name] = shufflePickerEntry{
+		signature: signature,
+		picker:    picker,
+	}
+	return picker
+}
+
+// newResponsePicker creates the picker for a response mode.
+func newResponsePicker(name, mode string, responses []string, weights []float64) (responsePicker, error) {
+	switch mode {
+	case "", responseModeRandom:
+		return newWeightedPicker(len(responses), weights)
+	case responseModeShuffle:
+		if len(weights) > 0 {
+			return nil, errors.New("Cannot use weights with the shuffle response mode")
+		}
+		return getShufflePicker(name, responses), nil
+	default:
+		return nil, errors.New("Invalid response mode " + mode)
+	}
+}
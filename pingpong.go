@@ -6,26 +6,35 @@ import (
 	"github.com/bwmarrin/discordgo" // for running the bot
 	"math/rand"
 	"regexp"
-	"time"
+	"strconv"
+	"text/template"
 )
 
 // PingPongCommand is a generic command that sends responses based on triggers.
 type PingPongCommand struct {
 	BaseCommand
 	PingPongConfig
-	RNG          *rand.Rand
+	picker       responsePicker
+	matcher      *textMatcher
 	Regexp       *regexp.Regexp
 	TriggerType  int
 	ResponseType int
+	components   []discordgo.MessageComponent
+	embed        *embedTemplate
+	actions      responseActions
+	attachments  attachmentSet
+	// Compiled response templates, with prefix and suffix.
+	// For a single response, this has one item.
+	responses []*template.Template
 }
 
 // Trigger types.
 const (
 	// Set if "trigger" is set in the config.
-	// Only triggers if one exact string is matched.
+	// Only triggers if one string is matched, according to the trigger mode.
 	triggerSingle int = iota
 	// Set if "triggers" is set in the config.
-	// Triggers if any one defined string is exactly matched.
+	// Triggers if any one defined string is matched, according to the trigger mode.
 	triggerMultiple
 	// Set if "triggerregex" is set in the config.
 	// Triggers if the message matches the given regular expression.
@@ -38,9 +47,13 @@ const (
 	// Set if "responses" is set in the config.
 	// Sends one response from a list pseudo-randomly.
 	responseMultiple
+	// Set if neither is set in the config.
+	// Only the embed and files, if any, are sent, which is also useful for commands that only react.
+	responseNone
 )
 
 // PingPongConfig is the configurator for the PingPong command.
+// Responses, prefixes and suffixes are templates, executed with a MessageContext.
 type PingPongConfig struct {
 	// Regular expression to trigger the command.
 	TriggerRegex string `json:"triggerregex"`
@@ -48,14 +61,41 @@ type PingPongConfig struct {
 	Triggers []string `json:"triggers"`
 	// Message that may trigger the command.
 	Trigger string `json:"trigger"`
+	// How "trigger" and "triggers" are matched against messages. One of
+	// "exact" (the default), "contains", "startswith" or "word" (whole-word contains).
+	TriggerMode string `json:"triggermode"`
+	// Match triggers case-insensitively. This also applies to "triggerregex".
+	IgnoreCase bool `json:"ignorecase"`
+	// Normalize messages and triggers before matching them, ignoring case,
+	// punctuation, emoji and extra whitespace.
+	Normalize bool `json:"normalize"`
+	// Percent chance (0-100) that the command fires when triggered.
+	// If unset, the command always fires; 0 means it never does.
+	TriggerChance *float64 `json:"triggerchance"`
 	// Response to send if the command is triggered.
 	Response string `json:"response"`
 	// List of responses to randomly send from if the command is triggered.
 	Responses []string `json:"responses"`
+	// Optional weights for each response in Responses.
+	// A response with weight 2 is twice as likely to be sent as one with weight 1.
+	Weights []float64 `json:"weights"`
+	// How to pick from Responses. Either "random" (the default) or "shuffle",
+	// which goes through every response in a random order before repeating any.
+	ResponseMode string `json:"responsemode"`
 	// Prefix to put before each response.
 	ResponsePrefix string `json:"responseprefix"`
 	// Suffix to put after each response.
 	ResponseSuffix string `json:"responsesuffix"`
+	// Rich embed to send with each response.
+	Embed *EmbedConfig `json:"embed"`
+	// Rows of buttons and select menus to attach to each response.
+	Components [][]ComponentConfig `json:"components"`
+	// What to do with the response. If unset, it's sent to the triggering channel.
+	Actions []ActionConfig `json:"actions"`
+	// Paths of local files (images, GIFs, sound clips...) to attach to each response.
+	Files []string `json:"files"`
+	// Path of a directory to attach a random file from with each response.
+	FileDirectory string `json:"filedirectory"`
 }
 
 // NewPingPongCommand creates a new PingPongCommand.
@@ -85,6 +125,13 @@ func NewPingPongCommand(config BaseCommand) (command PingPongCommand, err error)
 	if actives > 1 {
 		return command, errors.New("Cannot have more than one of 'trigger', 'triggers', or 'triggerregex' in the same PingPongCommand")
 	}
+	// Sanity check: trigger modes and normalizing only make sense for plain triggers
+	if ttype == triggerRegex && (len(options.TriggerMode) > 0 || options.Normalize) {
+		return command, errors.New("Cannot use 'triggermode' or 'normalize' with 'triggerregex'")
+	}
+	if options.TriggerChance != nil && (*options.TriggerChance < 0 || *options.TriggerChance > 100) {
+		return command, errors.New("'triggerchance' must be between 0 and 100")
+	}
 	// Sanity check: cannot have Response and Responses in the same command
 	if len(options.Response) > 0 && len(options.Responses) > 0 {
 		return command, errors.New("Cannot have 'response' and 'responses' in the same PingPongCommand")
@@ -97,6 +144,9 @@ func NewPingPongCommand(config BaseCommand) (command PingPongCommand, err error)
 	if len(options.Responses) > 0 {
 		rtype = responseMultiple
 	}
+	if rtype == -1 && (options.Embed != nil || len(options.Actions) > 0 || len(options.Files) > 0 || len(options.FileDirectory) > 0) {
+		rtype = responseNone
+	}
 	// Initialize command
 	command = PingPongCommand{
 		BaseCommand:    config,
@@ -106,63 +156,134 @@ func NewPingPongCommand(config BaseCommand) (command PingPongCommand, err error)
 	}
 	// Initialize regex, if necessary
 	if len(options.TriggerRegex) > 0 {
-		command.Regexp, err = regexp.Compile(options.TriggerRegex)
+		rgx := options.TriggerRegex
+		if options.IgnoreCase {
+			rgx = "(?i)" + rgx
+		}
+		command.Regexp, err = regexp.Compile(rgx)
+		if err != nil {
+			return command, err
+		}
+	}
+	// Initialize trigger matcher, if necessary
+	if ttype == triggerSingle || ttype == triggerMultiple {
+		triggers := options.Triggers
+		if ttype == triggerSingle {
+			triggers = []string{options.Trigger}
+		}
+		command.matcher, err = newTextMatcher(options.TriggerMode, options.IgnoreCase, options.Normalize, triggers)
+		if err != nil {
+			return command, err
+		}
+	}
+	// Compile response templates
+	responses := options.Responses
+	if rtype == responseSingle {
+		responses = []string{options.Response}
+	}
+	for i, response := range responses {
+		tmpl, err := newTemplate(config.Name+" response "+strconv.Itoa(i), options.ResponsePrefix+response+options.ResponseSuffix)
+		if err != nil {
+			return command, errors.New("Failed to compile response template: " + err.Error())
+		}
+		command.responses = append(command.responses, tmpl)
+	}
+	// Compile the embed, if any
+	if options.Embed != nil {
+		command.embed, err = newEmbedTemplate(config.Name, *options.Embed)
+		if err != nil {
+			return command, err
+		}
+	}
+	// Build components, if any
+	command.components, err = buildComponents(options.Components)
+	if err != nil {
+		return command, err
+	}
+	// Check attachments
+	command.attachments, err = newAttachmentSet(options.Files, options.FileDirectory)
+	if err != nil {
+		return command, err
+	}
+	// Set up actions
+	command.actions, err = newResponseActions(config.Name, options.Actions)
+	if err != nil {
+		return command, err
 	}
-	// Initialize RNG, if necessary
-	if len(options.Responses) > 1 {
-		command.RNG = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// Initialize response picker, if necessary
+	if rtype == responseMultiple {
+		command.picker, err = newResponsePicker(config.Name, options.ResponseMode, options.Responses, options.Weights)
+		if err != nil {
+			return command, err
+		}
 	}
 	return command, nil
 }
 
-// Test runs the necessary test based on set trigger type.
+// Test runs the necessary test based on set trigger type,
+// then rolls for the trigger chance, if one is set.
 func (p PingPongCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate) bool {
+	matched := false
 	switch p.TriggerType {
-	case triggerSingle:
-		if len(p.Trigger) > 0 {
-			if evt.Message.Content == p.Trigger {
-				return true
-			}
-		}
-	case triggerMultiple:
-		if len(p.Triggers) > 0 {
-			for _, trigger := range p.Triggers {
-				if evt.Message.Content == trigger {
-					return true
-				}
-			}
-		}
+	case triggerSingle, triggerMultiple:
+		matched = p.matcher.match(evt.Message.Content)
 	case triggerRegex:
 		if len(p.TriggerRegex) > 0 {
-			if p.Regexp.MatchString(evt.Message.Content) {
-				return true
-			}
+			matched = p.Regexp.MatchString(evt.Message.Content)
 		}
 	default: //uhhhHHHH
 		panic("No trigger type for " + p.GetName() + " on message " + evt.Message.Content)
 	}
-	return false
+	if !matched {
+		return false
+	}
+	if p.TriggerChance != nil && *p.TriggerChance < 100 {
+		return rand.Float64()*100 < *p.TriggerChance
+	}
+	return true
 }
 
-// Run either sends a static response or selects from a list of static responses.
+// Run either sends a response or selects from a list of responses,
+// along with the embed and files, if set.
 func (p PingPongCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) (err error) {
+	ctx := newMessageContext(bot, evt, p.Regexp)
+	msg := &discordgo.MessageSend{
+		Components: p.components,
+	}
 	switch p.ResponseType {
 	case responseSingle:
-		_, err = bot.ChannelMessageSend(evt.Message.ChannelID, p.ResponsePrefix+p.Response+p.ResponseSuffix)
+		msg.Content, err = executeTemplate(p.responses[0], ctx)
 		if err != nil {
 			return err
 		}
 	case responseMultiple:
 		if len(p.Responses) > 0 {
-			i := p.RNG.Intn(len(p.Responses))
-			// Send the response
-			_, err = bot.ChannelMessageSend(evt.Message.ChannelID, p.ResponsePrefix+p.Responses[i]+p.ResponseSuffix)
+			i := p.picker.pick(evt.Message.ChannelID)
+			msg.Content, err = executeTemplate(p.responses[i], ctx)
 			if err != nil {
 				return err
 			}
 		}
+	case responseNone:
 	default: //HHHHHHHH
 		panic("No response type for " + p.GetName() + " on message " + evt.Message.Content)
 	}
-	return nil
+	if p.embed != nil {
+		embed, err := p.embed.render(ctx)
+		if err != nil {
+			return err
+		}
+		msg.Embeds = []*discordgo.MessageEmbed{embed}
+	}
+	msg.Files, err = p.attachments.attachments()
+	if err != nil {
+		return err
+	}
+	// Send the response, or whatever else the actions do with it
+	return p.actions.perform(bot, evt, msg, ctx)
+}
+
+// getComponents returns the component config, so the handler can route interactions.
+func (p PingPongCommand) getComponents() [][]ComponentConfig {
+	return p.Components
 }
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
+	"sync"
 )
 
+// reloadMu is held while the bot config is reloaded.
+var reloadMu sync.Mutex
+
 // ReloadCommand is a meta-command which reloads commands.
 // This should generally only be triggered by admins and bot owners.
 // Keep it properly whitelisted.
@@ -41,16 +45,28 @@ func (c ReloadCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate
 
 // Run reloads commands.
 func (c ReloadCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) error {
-	// Re-read bot config
-	var err error
-	config, err = ReadBotConfig(*configPath)
+	// Only one reload at a time, so nothing else reads the config while it's replaced
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	// Re-read bot config. Commands read the global config while they're being built,
+	// so it's swapped in now, and put back if the new config doesn't work.
+	oldconfig := config
+	newconfig, err := ReadBotConfig(*configPath)
+	if err != nil {
+		bot.ChannelMessageSend(evt.Message.ChannelID, "Failed to reload commands.")
+		return err
+	}
+	useConfig(newconfig)
+	// Build the new event hooks and handler, only using them once both work
+	hooks, err := newEventHooks(config.EventHooks)
 	if err != nil {
+		useConfig(oldconfig)
 		bot.ChannelMessageSend(evt.Message.ChannelID, "Failed to reload commands.")
 		return err
 	}
-	// Try to make the new handler
 	newhandler, err := NewHandler(bot, config.Commands)
 	if err != nil {
+		useConfig(oldconfig)
 		bot.ChannelMessageSend(evt.Message.ChannelID, "Failed to reload commands.")
 		return err
 	}
@@ -58,6 +74,8 @@ func (c ReloadCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate)
 	// NOTE Doesn't this mean a small window in which commands could double-trigger?
 	handler.DestroySelf()
 	handler = newhandler
+	events.setHooks(hooks)
+	events.emit(Event{Type: eventReload, Commands: len(handler.commands)})
 	// Log the success
 	_, err = bot.ChannelMessageSend(evt.Message.ChannelID, fmt.Sprintf("Commands reloaded! Parsed %d commands.", len(handler.commands)))
 	if err != nil {
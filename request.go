@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Body formats for REST requests.
+const (
+	// The body template is sent as-is.
+	bodyFormatRaw = "raw"
+	// The body template must render valid JSON.
+	bodyFormatJSON = "json"
+	// The form fields are sent URL-encoded.
+	bodyFormatForm = "form"
+)
+
+// RequestConfig is the configuration for the HTTP request a RESTCommand makes.
+// The endpoint, header values, query parameters, the body and form fields are templates,
+// executed with a MessageContext for the triggering message.
+type RequestConfig struct {
+	// Endpoint to hit, as a URL template, e.g. "https://example.com/users/{{.Named.user}}".
+	// Everything the template outputs is escaped for the part of the URL it's in;
+	// use the "raw" function to insert a value as-is, e.g. {{raw .Named.path}}.
+	// For compatibility, this can also be an array of a format string followed by the
+	// numbers of the trigger's capture groups to fill it in with, e.g. ["https://example.com/%s", 1].
+	Endpoint interface{} `json:"endpoint"`
+	// HTTP method. Defaults to GET.
+	Method string `json:"method"`
+	// Headers to send.
+	Headers map[string]string `json:"headers"`
+	// Query parameters to add to the endpoint.
+	// Parameters that render empty are left out.
+	Query map[string]string `json:"query"`
+	// Request body.
+	Body string `json:"body"`
+	// Format of the body: "raw", "json" or "form".
+	// Defaults to "form" if form fields are set, and "raw" otherwise.
+	BodyFormat string `json:"bodyformat"`
+	// Form fields, sent URL-encoded in the body.
+	Form map[string]string `json:"form"`
+	// Name of the auth profile (from the bot config's authProfiles) to authenticate with.
+	Auth string `json:"auth"`
+}
+
+// restRequest is a compiled RequestConfig.
+type restRequest struct {
+	method         string
+	endpoint       *template.Template
+	endpointstring string
+	endpointgroups []int
+	headers        map[string]*template.Template
+	query          map[string]*template.Template
+	body           *template.Template
+	bodyformat     string
+	form           map[string]*template.Template
+	auth           authProvider
+	// Method and endpoint template, which the circuit breaker is keyed by.
+	// This leaves out what's filled in from the message, so every request
+	// to the same API endpoint shares a breaker.
+	breakerKey string
+	// Renders the body instead of the body template, for request types
+	// that build their own JSON bodies, like GraphQL.
+	renderBody func(ctx MessageContext) ([]byte, error)
+	// Gets the error out of the body of a failed response, for APIs whose errors
+	// say more than the status does, like GraphQL. Returns nil if there's nothing useful in it.
+	parseError func(body []byte) error
+}
+
+// compileTemplateMap compiles a map of templates.
+func compileTemplateMap(name string, texts map[string]string) (map[string]*template.Template, error) {
+	tmpls := make(map[string]*template.Template)
+	for key, text := range texts {
+		tmpl, err := newTemplate(name+" "+key, text)
+		if err != nil {
+			return nil, errors.New("Failed to compile " + name + " template " + key + ": " + err.Error())
+		}
+		tmpls[key] = tmpl
+	}
+	return tmpls, nil
+}
+
+// newRESTRequest compiles a RequestConfig, checking the endpoint against the trigger regex.
+func newRESTRequest(name string, config RequestConfig, rgx *regexp.Regexp) (req *restRequest, err error) {
+	req = &restRequest{
+		method: strings.ToUpper(config.Method),
+	}
+	switch endpoint := config.Endpoint.(type) {
+	case string:
+		req.endpoint, err = newTemplate(name+" endpoint", endpoint)
+		if err != nil {
+			return nil, errors.New("Failed to compile endpoint template: " + err.Error())
+		}
+		err = escapeEndpointTemplate(req.endpoint)
+		if err != nil {
+			return nil, errors.New("Failed to compile endpoint template: " + err.Error())
+		}
+	case []interface{}:
+		err = req.parseEndpointArray(endpoint, rgx)
+		if err != nil {
+			return nil, err
+		}
+	case nil:
+		return nil, errors.New("Endpoint must be set")
+	default:
+		return nil, errors.New("Endpoint must be a string or an array")
+	}
+	method := req.method
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	req.breakerKey = method + " " + req.endpointstring
+	if req.endpoint != nil {
+		req.breakerKey = method + " " + req.endpoint.Root.String()
+	}
+	// Compile templates
+	req.headers, err = compileTemplateMap(name+" header", config.Headers)
+	if err != nil {
+		return nil, err
+	}
+	req.query, err = compileTemplateMap(name+" query", config.Query)
+	if err != nil {
+		return nil, err
+	}
+	req.form, err = compileTemplateMap(name+" form", config.Form)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Body) > 0 {
+		req.body, err = newTemplate(name+" body", config.Body)
+		if err != nil {
+			return nil, errors.New("Failed to compile body template: " + err.Error())
+		}
+	}
+	// Figure out the body format
+	req.bodyformat = config.BodyFormat
+	switch req.bodyformat {
+	case "":
+		if len(config.Form) > 0 {
+			req.bodyformat = bodyFormatForm
+		} else {
+			req.bodyformat = bodyFormatRaw
+		}
+	case bodyFormatRaw, bodyFormatJSON, bodyFormatForm:
+	default:
+		return nil, errors.New("Invalid body format " + config.BodyFormat)
+	}
+	if req.bodyformat == bodyFormatForm && len(config.Body) > 0 {
+		return nil, errors.New("Cannot have a body with the form body format; use form instead")
+	}
+	// Look up the auth profile
+	if len(config.Auth) > 0 {
+		req.auth, err = getAuthProvider(config.Auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// parseEndpointArray parses an endpoint in the old array format,
+// a format string followed by capture group numbers.
+func (r *restRequest) parseEndpointArray(endpoint []interface{}, rgx *regexp.Regexp) error {
+	if len(endpoint) == 0 {
+		return errors.New("Endpoint must be set")
+	}
+	format, ok := endpoint[0].(string)
+	if !ok {
+		return errors.New("First of endpoint array should be a string")
+	}
+	r.endpointstring = format
+	for _, item := range endpoint[1:] {
+		// the json package gives us float64s, so make sure they're actually group numbers
+		f, ok := item.(float64)
+		if !ok || f != math.Trunc(f) {
+			return errors.New("All items after string in endpoint must be whole numbers")
+		}
+		i := int(f)
+		if i < 0 || i > rgx.NumSubexp() {
+			return errors.New("Endpoint refers to group " + strconv.Itoa(i) + ", but the trigger only has " + strconv.Itoa(rgx.NumSubexp()))
+		}
+		r.endpointgroups = append(r.endpointgroups, i)
+	}
+	return nil
+}
+
+// buildEndpoint renders the endpoint URL for a message.
+func (r *restRequest) buildEndpoint(ctx MessageContext) (*url.URL, error) {
+	var endpoint string
+	if r.endpoint != nil {
+		var err error
+		endpoint, err = executeTemplate(r.endpoint, ctx)
+		if err != nil {
+			return nil, errors.New("could not execute endpoint template: " + err.Error())
+		}
+		endpoint = strings.TrimSpace(endpoint)
+	} else {
+		var reqfmtgroups []interface{}
+		for _, i := range r.endpointgroups {
+			var group string
+			if i < len(ctx.Groups) {
+				group = ctx.Groups[i]
+			}
+			reqfmtgroups = append(reqfmtgroups, url.QueryEscape(group))
+		}
+		endpoint = fmt.Sprintf(r.endpointstring, reqfmtgroups...)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.New("invalid endpoint: " + err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("endpoint " + endpoint + " is not an http(s) URL")
+	}
+	return u, nil
+}
+
+// build creates the HTTP request for a message.
+func (r *restRequest) build(ctx MessageContext) (*http.Request, error) {
+	// Construct the endpoint
+	u, err := r.buildEndpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Add query parameters
+	if len(r.query) > 0 {
+		values := u.Query()
+		for key, tmpl := range r.query {
+			value, err := executeTemplate(tmpl, ctx)
+			if err != nil {
+				return nil, errors.New("could not execute query template " + key + ": " + err.Error())
+			}
+			if len(value) > 0 {
+				values.Set(key, value)
+			}
+		}
+		u.RawQuery = values.Encode()
+	}
+	// Render the body
+	var (
+		body        []byte
+		contentType string
+	)
+	switch {
+	case r.renderBody != nil:
+		body, err = r.renderBody(ctx)
+		if err != nil {
+			return nil, err
+		}
+		contentType = "application/json"
+	case r.bodyformat == bodyFormatForm:
+		if len(r.form) > 0 {
+			values := url.Values{}
+			for key, tmpl := range r.form {
+				value, err := executeTemplate(tmpl, ctx)
+				if err != nil {
+					return nil, errors.New("could not execute form template " + key + ": " + err.Error())
+				}
+				values.Set(key, value)
+			}
+			body = []byte(values.Encode())
+			contentType = "application/x-www-form-urlencoded"
+		}
+	case r.body != nil:
+		rendered, err := executeTemplate(r.body, ctx)
+		if err != nil {
+			return nil, errors.New("could not execute body template: " + err.Error())
+		}
+		if r.bodyformat == bodyFormatJSON {
+			if !json.Valid([]byte(rendered)) {
+				return nil, errors.New("body template did not render valid JSON")
+			}
+			contentType = "application/json"
+		}
+		body = []byte(rendered)
+	}
+	// Construct request based on this endpoint
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(r.method, u.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+	// Set headers, which can override the content type
+	for key, tmpl := range r.headers {
+		value, err := executeTemplate(tmpl, ctx)
+		if err != nil {
+			return nil, errors.New("could not execute header template " + key + ": " + err.Error())
+		}
+		request.Header.Set(key, value)
+	}
+	// Authenticate last, so signatures cover everything
+	// (and the cache only sees the headers that identify the response)
+	request = withCacheHeaders(request)
+	if r.auth != nil {
+		err = r.auth.apply(request, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return request, nil
+}
+
+// authRejected lets the auth provider know the server rejected its credentials,
+// so providers with cached tokens can get new ones.
+func (r *restRequest) authRejected() {
+	if o, ok := r.auth.(*oauth2Auth); ok {
+		o.invalidate()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestBuildEndpointEscapesGroups(t *testing.T) {
+	rgx := regexp.MustCompile(`^!lookup (?P<user>\S+)(?: (?P<q>.+))?$`)
+	tests := []struct {
+		name     string
+		endpoint string
+		message  string
+		want     string
+	}{
+		{"path segment", "https://example.com/users/{{.Named.user}}", "!lookup a/b?c", "https://example.com/users/a%2Fb%3Fc"},
+		{"path segment with spaces", "https://example.com/users/{{index .Groups 2}}", "!lookup x hello world", "https://example.com/users/hello%20world"},
+		{"query value", "https://example.com/search?user={{.Named.user}}&q={{.Named.q}}", "!lookup a&b=c one+two", "https://example.com/search?user=a%26b%3Dc&q=one%2Btwo"},
+		{"fragment", "https://example.com/#{{.Named.user}}", "!lookup a#b", "https://example.com/#a%23b"},
+		{"through a function", "https://example.com/users/{{.Named.user | lower}}", "!lookup A/B", "https://example.com/users/a%2Fb"},
+		{"inside with", "https://example.com/users/{{with .Named.user}}{{.}}{{end}}", "!lookup a/b", "https://example.com/users/a%2Fb"},
+		{"already escaped", "https://example.com/users/{{path .Named.user}}", "!lookup a/b", "https://example.com/users/a%2Fb"},
+		{"raw", "https://example.com/{{raw .Named.user}}", "!lookup a/b", "https://example.com/a/b"},
+		{"other values", "https://example.com/{{.Content | len}}/{{.Named.user}}", "!lookup a/b", "https://example.com/11/a%2Fb"},
+		{"args", "https://example.com/search?q={{index .Args 0}}", "!lookup a&b=c", "https://example.com/search?q=a%26b%3Dc"},
+		{"content", "https://example.com/{{.Content}}", "!lookup a/b", "https://example.com/%21lookup%20a%2Fb"},
+		{"variable", "https://example.com/users/{{$u := .Named.user}}{{$u}}", "!lookup a/b", "https://example.com/users/a%2Fb"},
+		{"called template", `{{define "user"}}{{.Named.user}}{{end}}https://example.com/users/{{template "user" .}}`, "!lookup a/b", "https://example.com/users/a%2Fb"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := newRESTRequest("test", RequestConfig{Endpoint: test.endpoint}, rgx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := MessageContext{Content: test.message, Args: strings.Fields(test.message)[1:]}
+			ctx.setMatch(rgx, rgx.FindStringSubmatch(test.message))
+			u, err := req.buildEndpoint(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.String() != test.want {
+				t.Errorf("got %s, want %s", u, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"golang.org/x/net/html"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Response formats for REST responses.
+const (
+	responseFormatJSON = "json"
+	responseFormatText = "text"
+	responseFormatXML  = "xml"
+	responseFormatCSV  = "csv"
+	responseFormatHTML = "html"
+	// JSON in the GraphQL response format; see parseGraphQL.
+	responseFormatGraphQL = "graphql"
+)
+
+// responseParser parses REST response bodies into data for templates.
+type responseParser struct {
+	// Format to parse as. If empty, it's detected from the Content-Type of each response.
+	format string
+	// Selectors to extract from HTML responses, by name.
+	selectors map[string]htmlSelector
+}
+
+// newResponseParser creates a responseParser, compiling the HTML selectors.
+func newResponseParser(format string, selectors map[string]string) (parser responseParser, err error) {
+	switch format {
+	case "", responseFormatJSON, responseFormatText, responseFormatXML, responseFormatCSV, responseFormatHTML, responseFormatGraphQL:
+	default:
+		return parser, errors.New("Invalid response format " + format)
+	}
+	parser.format = format
+	parser.selectors = make(map[string]htmlSelector)
+	for name, selector := range selectors {
+		if name == "all" {
+			return parser, errors.New("Selectors cannot be named 'all'")
+		}
+		parser.selectors[name], err = newHTMLSelector(selector)
+		if err != nil {
+			return parser, errors.New("Invalid selector " + name + ": " + err.Error())
+		}
+	}
+	return parser, nil
+}
+
+// detectFormat guesses a response format from a Content-Type header.
+// Anything unrecognized is assumed to be JSON, since that's what most APIs send.
+func detectFormat(contentType string) string {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return responseFormatJSON
+	}
+	switch {
+	case mediatype == "application/json" || strings.HasSuffix(mediatype, "+json"):
+		return responseFormatJSON
+	case mediatype == "text/html" || mediatype == "application/xhtml+xml":
+		return responseFormatHTML
+	case mediatype == "text/xml" || mediatype == "application/xml" || strings.HasSuffix(mediatype, "+xml"):
+		return responseFormatXML
+	case mediatype == "text/csv":
+		return responseFormatCSV
+	case strings.HasPrefix(mediatype, "text/"):
+		return responseFormatText
+	}
+	return responseFormatJSON
+}
+
+// parse parses a response body. contentType is used if no format is configured.
+//
+// The result depends on the format:
+//
+//	json - the decoded JSON
+//	text - the body as a string
+//	xml  - nested maps, with attributes as "-name" keys, text as "#text",
+//	       and repeated elements as lists
+//	csv  - a map with "header" (the first row), "rows" (the other rows),
+//	       and "records" (the other rows as maps keyed by the header)
+//	html - a map of each selector's name to its first match, plus "all",
+//	       a map of each selector's name to all of its matches
+//	graphql - a GraphQLContext, with the response's data and errors
+func (p responseParser) parse(body []byte, contentType string) (interface{}, error) {
+	format := p.format
+	if len(format) == 0 {
+		format = detectFormat(contentType)
+	}
+	switch format {
+	case responseFormatText:
+		return string(body), nil
+	case responseFormatXML:
+		return parseXML(body)
+	case responseFormatCSV:
+		return parseCSV(body)
+	case responseFormatHTML:
+		return p.parseHTML(body)
+	case responseFormatGraphQL:
+		return parseGraphQL(body)
+	default:
+		var bodyjson interface{}
+		err := json.Unmarshal(body, &bodyjson)
+		return bodyjson, err
+	}
+}
+
+// parseHTML runs the configured selectors over an HTML document.
+func (p responseParser) parseHTML(body []byte) (interface{}, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	all := make(map[string][]string)
+	for name, selector := range p.selectors {
+		values := selector.extract(doc)
+		all[name] = values
+		if len(values) > 0 {
+			data[name] = values[0]
+		} else {
+			data[name] = ""
+		}
+	}
+	data["all"] = all
+	return data, nil
+}
+
+// parseCSV parses a CSV document, using the first row as the header.
+func parseCSV(body []byte) (interface{}, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{
+		"header":  []string{},
+		"rows":    [][]string{},
+		"records": []map[string]string{},
+	}
+	if len(rows) == 0 {
+		return data, nil
+	}
+	header := rows[0]
+	records := []map[string]string{}
+	for _, row := range rows[1:] {
+		record := make(map[string]string)
+		for i, name := range header {
+			if i < len(row) {
+				record[name] = row[i]
+			}
+		}
+		records = append(records, record)
+	}
+	data["header"] = header
+	data["rows"] = rows[1:]
+	data["records"] = records
+	return data, nil
+}
+
+// xmlElement is an XML element being built up by parseXML.
+type xmlElement struct {
+	name     string
+	children map[string]interface{}
+	text     strings.Builder
+}
+
+// value simplifies an element: elements with only text become strings.
+func (e *xmlElement) value() interface{} {
+	text := strings.TrimSpace(e.text.String())
+	if len(e.children) == 0 {
+		return text
+	}
+	if len(text) > 0 {
+		e.children["#text"] = text
+	}
+	return e.children
+}
+
+// add adds a child value, turning repeated elements into lists.
+func (e *xmlElement) add(name string, value interface{}) {
+	existing, ok := e.children[name]
+	if !ok {
+		e.children[name] = value
+		return
+	}
+	if list, ok := existing.([]interface{}); ok {
+		e.children[name] = append(list, value)
+	} else {
+		e.children[name] = []interface{}{existing, value}
+	}
+}
+
+// parseXML parses an XML document into nested maps.
+func parseXML(body []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	// don't choke on documents that aren't UTF-8
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	root := &xmlElement{children: make(map[string]interface{})}
+	stack := []*xmlElement{root}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		current := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := &xmlElement{
+				name:     t.Name.Local,
+				children: make(map[string]interface{}),
+			}
+			for _, attr := range t.Attr {
+				element.children["-"+attr.Name.Local] = attr.Value
+			}
+			stack = append(stack, element)
+		case xml.EndElement:
+			if len(stack) < 2 {
+				return nil, errors.New("unexpected end element " + t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1].add(current.name, current.value())
+		case xml.CharData:
+			current.text.Write(t)
+		}
+	}
+	return root.children, nil
+}
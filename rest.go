@@ -1,41 +1,128 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"github.com/bwmarrin/discordgo" // for running the bot
-	"github.com/gregjones/httpcache"
+	"github.com/bwmarrin/discordgo"  // for running the bot
 	log "github.com/sirupsen/logrus" // logging suite
 	"io/ioutil"                      // for opening response body
 	"net/http"
-	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
+// defaultMaxMatches is how many matches allmatches commands look up by default.
+const defaultMaxMatches = 5
+
 // RESTCommand base structure.
 type RESTCommand struct {
 	BaseCommand
 	RESTConfig
-	regexp         *regexp.Regexp
-	endpointstring string
-	endpointgroups []int
-	template       *template.Template
-	client         http.Client
+	regexp          *regexp.Regexp
+	steps           []restStep
+	attachment      *restAttachment
+	template        *template.Template
+	client          *http.Client
+	retry           retryPolicy
+	breakerFailures int
+	breakerCooldown time.Duration
+	components      []discordgo.MessageComponent
+	embed           *embedTemplate
+	actions         responseActions
 }
 
 // RESTConfig is the configuration for the RESTCommand.
 type RESTConfig struct {
-	TriggerRegex     string            `json:"triggerregex"`
-	Endpoint         []interface{}     `json:"endpoint"`
-	Method           string            `json:"method"`
-	Response         string            `json:"response"`
-	ResponseFilepath string            `json:"responseFile"`
-	ErrorMessage     string            `json:"errorMessage"`
-	Headers          map[string]string `json:"headers"`
-	DisableCache     bool              `json:"disablecache"`
+	TriggerRegex string `json:"triggerregex"`
+	RequestConfig
+	Response         string `json:"response"`
+	ResponseFilepath string `json:"responseFile"`
+	ErrorMessage     string `json:"errorMessage"`
+	DisableCache     bool   `json:"disablecache"`
+	// Requests to make in order, for lookups that need more than one.
+	// Each step's parsed response is available to later steps' templates through
+	// MessageContext's Steps and Results, and the response template gets the MessageContext
+	// with every step's results. Cannot be used along with endpoint.
+	Steps []RESTStepConfig `json:"steps"`
+	// Format of the response: "json", "text", "xml", "csv" or "html".
+	// If unset, it's detected from the response's Content-Type.
+	ResponseFormat string `json:"responseformat"`
+	// CSS selectors (or XPath expressions, prefixed with "xpath:") to extract from HTML responses, by name.
+	Selectors map[string]string `json:"selectors"`
+	// How long to wait for each request, e.g. "5s". Defaults to 15 seconds.
+	Timeout string `json:"timeout"`
+	// How many times to retry requests that fail with a connection error, a 5xx response
+	// or a 429 response. Retries back off exponentially, and respect Retry-After.
+	// Only GET, HEAD, OPTIONS and TRACE requests are retried, unless retryunsafe is set. At most 10.
+	Retries int `json:"retries"`
+	// Retry POST, PUT, PATCH and DELETE requests too. Only set this if the API
+	// can safely get the same request twice, since a failed request may have gone through.
+	RetryUnsafe bool `json:"retryunsafe"`
+	// How long to wait before the first retry, e.g. "1s". Doubles after each retry.
+	// Defaults to half a second.
+	RetryBackoff string `json:"retrybackoff"`
+	// If set, stops making requests to an endpoint for a while after it fails
+	// too many times in a row, sending the error message straight away instead.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuitbreaker"`
+	// Name of the HTTP profile (from the bot config's httpProfiles) to make requests with,
+	// for proxies, custom CAs and client certificates.
+	HTTPProfile string `json:"httpprofile"`
+	// HTTP profile for just this command, instead of a shared one.
+	HTTP *HTTPProfileConfig `json:"http"`
+	// How long to cache responses for, e.g. "10m", overriding the cache headers the API sends.
+	// Useful for APIs that don't send any.
+	CacheTTL string `json:"cachettl"`
+	// Rich embed to send, rendered with the parsed response like the response template.
+	Embed *EmbedConfig `json:"embed"`
+	// Rows of buttons and select menus to attach to the response.
+	Components [][]ComponentConfig `json:"components"`
+	// Send a file from the response, either the body itself or a file it links to.
+	// If the body is the file, the response template and embed get an AttachmentContext
+	// instead of the parsed response.
+	Attachment *RESTAttachmentConfig `json:"attachment"`
+	// What to do with the response. If unset, it's sent to the triggering channel.
+	Actions []ActionConfig `json:"actions"`
+	// Make requests for every match of the trigger regex in the message, not just the first.
+	// The requests are made concurrently, and matches with identical capture groups are only looked up once.
+	AllMatches bool `json:"allmatches"`
+	// Maximum number of matches to make requests for. Defaults to 5.
+	MaxMatches int `json:"maxmatches"`
+	// How to send the responses to each match: "combine" (the default) sends one message with every
+	// rendered response, "separate" sends a message per match.
+	MatchMode string `json:"matchmode"`
+}
+
+// RESTStepConfig is the configuration for a single request in a chained RESTCommand.
+type RESTStepConfig struct {
+	// Name to refer to the step's result by, as .Steps.<name>. Defaults to the step's number.
+	Name string `json:"name"`
+	RequestConfig
+	// Format of the response, as in RESTConfig.
+	ResponseFormat string `json:"responseformat"`
+	// HTML selectors, as in RESTConfig.
+	Selectors map[string]string `json:"selectors"`
+}
+
+// restStep is a compiled RESTStepConfig.
+type restStep struct {
+	name    string
+	request *restRequest
+	parser  responseParser
+}
+
+// newRESTStep compiles a RESTStepConfig.
+func newRESTStep(name string, config RESTStepConfig, rgx *regexp.Regexp) (step restStep, err error) {
+	step.name = config.Name
+	step.request, err = newRESTRequest(name, config.RequestConfig, rgx)
+	if err != nil {
+		return step, err
+	}
+	step.parser, err = newResponseParser(config.ResponseFormat, config.Selectors)
+	return step, err
 }
 
 // NewRESTCommand generates a new RESTCommand.
@@ -43,8 +130,14 @@ func NewRESTCommand(config BaseCommand) (command RESTCommand, err error) {
 	var options RESTConfig
 	err = json.Unmarshal(config.Options, &options)
 	if err != nil {
-		return command, nil
+		return command, err
 	}
+	return newRESTCommand(config, options)
+}
+
+// newRESTCommand generates a RESTCommand from already parsed options,
+// for command types built on top of it.
+func newRESTCommand(config BaseCommand, options RESTConfig) (command RESTCommand, err error) {
 	// Ensure only one of Response and ResponseFilepath is set
 	if len(options.Response) > 0 && len(options.ResponseFilepath) > 0 {
 		return command, errors.New("Can only have one of response and responseFile")
@@ -53,62 +146,165 @@ func NewRESTCommand(config BaseCommand) (command RESTCommand, err error) {
 	var tmplstr string
 	if len(options.Response) > 0 {
 		tmplstr = options.Response
-	} else {
+	} else if len(options.ResponseFilepath) > 0 || (options.Embed == nil && options.Attachment == nil && len(options.Actions) == 0) {
 		tmplbytes, err := ioutil.ReadFile(options.ResponseFilepath)
 		if err != nil {
 			return command, errors.New("Error reading response file: " + err.Error())
 		}
 		tmplstr = string(tmplbytes)
 	}
-	// Compile the template
-	tmpl, err := template.New(config.Name).Parse(tmplstr)
-	if err != nil {
-		return command, errors.New("Failed to compile template: " + err.Error())
-	}
-	// Ensure the endpoint and response commands are of their correct types.
-	endpoint, ok := options.Endpoint[0].(string)
-	if !ok {
-		return command, errors.New("First of endpoint array should be a string")
+	// Compile the template, if there is one (embed-only commands don't need it)
+	var tmpl *template.Template
+	if len(tmplstr) > 0 {
+		tmpl, err = newTemplate(config.Name, tmplstr)
+		if err != nil {
+			return command, errors.New("Failed to compile template: " + err.Error())
+		}
 	}
-	var endpointgroups []int
-	for _, item := range options.Endpoint[1:] {
-		// it HAS to cast to float64 because of the json package,
-		// but this means it allows non-integer numbers without whining which is PURE JANK
-		// gfdi
-		i, ok := item.(float64)
-		if !ok {
-			return command, errors.New("All items after string in endpoint must be numbers")
+	// Compile the embed, if any
+	var embed *embedTemplate
+	if options.Embed != nil {
+		embed, err = newEmbedTemplate(config.Name, *options.Embed)
+		if err != nil {
+			return command, err
 		}
-		endpointgroups = append(endpointgroups, int(i))
+	}
+	// Check the match options
+	if options.MaxMatches < 0 {
+		return command, errors.New("maxmatches cannot be negative")
+	}
+	if options.MaxMatches == 0 {
+		options.MaxMatches = defaultMaxMatches
+	}
+	switch options.MatchMode {
+	case "":
+		options.MatchMode = "combine"
+	case "combine", "separate":
+	default:
+		return command, errors.New("Invalid matchmode " + options.MatchMode)
 	}
 	// Instantiate the regex.
 	rgx, err := regexp.Compile(options.TriggerRegex)
 	if err != nil {
-		return command, nil
+		return command, err
+	}
+	// Compile the request, or each step's request for chained commands
+	var steps []restStep
+	if len(options.Steps) > 0 {
+		if options.Endpoint != nil {
+			return command, errors.New("Cannot have both endpoint and steps")
+		}
+		for i, stepconfig := range options.Steps {
+			if len(stepconfig.Name) == 0 {
+				stepconfig.Name = strconv.Itoa(i + 1)
+			}
+			step, err := newRESTStep(config.Name+" step "+stepconfig.Name, stepconfig, rgx)
+			if err != nil {
+				return command, errors.New("Error with step " + stepconfig.Name + ": " + err.Error())
+			}
+			steps = append(steps, step)
+		}
+	} else {
+		step, err := newRESTStep(config.Name, RESTStepConfig{
+			RequestConfig:  options.RequestConfig,
+			ResponseFormat: options.ResponseFormat,
+			Selectors:      options.Selectors,
+		}, rgx)
+		if err != nil {
+			return command, err
+		}
+		steps = append(steps, step)
+	}
+	// Set up the attachment, if any
+	var attachment *restAttachment
+	if options.Attachment != nil {
+		attachment, err = newRESTAttachment(config.Name, *options.Attachment)
+		if err != nil {
+			return command, err
+		}
+	}
+	// Build components, if any
+	components, err := buildComponents(options.Components)
+	if err != nil {
+		return command, err
 	}
-	// Sanity check: is the number of endpoint groups the number of groups in the regex?
-	// The command will panic otherwise
-	if len(endpointgroups) != rgx.NumSubexp() {
-		return command, errors.New("Number of groups in trigger does not match number of groups in regex")
+	// Set up actions
+	actions, err := newResponseActions(config.Name, options.Actions)
+	if err != nil {
+		return command, err
 	}
 	// generate the command
 	command = RESTCommand{
-		BaseCommand:    config,
-		RESTConfig:     options,
-		regexp:         rgx,
-		endpointstring: endpoint,
-		endpointgroups: endpointgroups,
-		template:       tmpl,
+		BaseCommand: config,
+		RESTConfig:  options,
+		regexp:      rgx,
+		steps:       steps,
+		attachment:  attachment,
+		template:    tmpl,
+		components:  components,
+		embed:       embed,
+		actions:     actions,
+	}
+	// set up timeouts, retries and the circuit breaker
+	timeout := defaultRequestTimeout
+	if len(options.Timeout) > 0 {
+		timeout, err = time.ParseDuration(options.Timeout)
+		if err != nil {
+			return command, errors.New("Invalid timeout: " + err.Error())
+		}
+	}
+	if options.Retries < 0 {
+		return command, errors.New("retries cannot be negative")
+	}
+	if options.Retries > maxRetries {
+		return command, errors.New("retries cannot be more than " + strconv.Itoa(maxRetries))
+	}
+	command.retry = retryPolicy{
+		retries: options.Retries,
+		backoff: defaultRetryBackoff,
+		unsafe:  options.RetryUnsafe,
+	}
+	if len(options.RetryBackoff) > 0 {
+		command.retry.backoff, err = time.ParseDuration(options.RetryBackoff)
+		if err != nil || command.retry.backoff <= 0 {
+			return command, errors.New("Invalid retrybackoff " + options.RetryBackoff)
+		}
+	}
+	if options.CircuitBreaker != nil {
+		command.breakerFailures = options.CircuitBreaker.Failures
+		if command.breakerFailures <= 0 {
+			command.breakerFailures = defaultBreakerFailures
+		}
+		command.breakerCooldown = defaultBreakerCooldown
+		if len(options.CircuitBreaker.Cooldown) > 0 {
+			command.breakerCooldown, err = time.ParseDuration(options.CircuitBreaker.Cooldown)
+			if err != nil {
+				return command, errors.New("Invalid circuit breaker cooldown: " + err.Error())
+			}
+		}
+	}
+	// set up the transport, with the HTTP profile if there is one
+	profile, err := resolveHTTPProfile(options.HTTPProfile, options.HTTP)
+	if err != nil {
+		return command, err
+	}
+	transport, err := newHTTPTransport(profile)
+	if err != nil {
+		return command, err
 	}
 	// set the client based on if this restcommand is cached
 	if options.DisableCache {
-		command.client = http.Client{}
+		command.client = newHTTPClient(transport, timeout)
 	} else {
 		// use a caching transport to stop the bot from flooding servers with identical requests, if the config allows
-		command.client = http.Client{
-			Transport: httpcache.NewMemoryCacheTransport(),
+		var ttl time.Duration
+		if len(options.CacheTTL) > 0 {
+			ttl, err = time.ParseDuration(options.CacheTTL)
+			if err != nil {
+				return command, errors.New("Invalid cachettl: " + err.Error())
+			}
 		}
-		command.client = http.Client{}
+		command.client = newHTTPClient(newCachingTransport(config.Name, transport, ttl), timeout)
 	}
 	return command, nil
 }
@@ -124,64 +320,279 @@ func (r RESTCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate)
 	return r.regexp.MatchString(evt.Message.Content)
 }
 
-// Run hits the given REST endpoint, gets a comic, and returns it as an embed.
+// Run hits the given REST endpoint (or endpoints), and sends the templated response.
 func (r RESTCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) (err error) {
-	// Construct the endpoint
-	rgxgroups := r.regexp.FindAllStringSubmatch(evt.Message.Content, -1)[0]
-	var reqfmtgroups []interface{}
-	for _, i := range r.endpointgroups {
-		reqfmtgroups = append(reqfmtgroups, url.QueryEscape(rgxgroups[i]))
-	}
-	endpoint := fmt.Sprintf(r.endpointstring, reqfmtgroups...)
-	// Construct request based on this endpoint
-	request, err := http.NewRequest(r.Method, endpoint, nil)
+	if r.AllMatches {
+		return r.runAll(bot, evt)
+	}
+	ctx := newMessageContext(bot, evt, r.regexp)
+	msg, data, err := r.render(ctx)
 	if err != nil {
 		r.sendErrorMessage(bot, evt)
 		return err
 	}
-	// Set headers
-	for key, value := range r.Headers {
-		request.Header.Set(key, value)
-	}
-	// Log that we're about to send the request, in case someone's trying something nasty
-	log.WithFields(log.Fields{
-		"endpoint": endpoint,
-		"method":   r.Method,
-	}).Info("Making HTTP request")
-	// Send request, ensure nothing failed, get JSON bytes
-	resp, err := r.client.Do(request)
+	return r.actions.perform(bot, evt, msg, data)
+}
+
+// matchResult is the rendered response to one match of the trigger regex.
+type matchResult struct {
+	msg  *discordgo.MessageSend
+	data interface{}
+	err  error
+}
+
+// runAll renders a response for every match in the message concurrently, and sends them.
+// Matches that fail are left out; the error message is only sent if they all fail.
+func (r RESTCommand) runAll(bot *discordgo.Session, evt *discordgo.MessageCreate) error {
+	contexts := newMatchContexts(bot, evt, r.regexp, r.MaxMatches)
+	results := make([]matchResult, len(contexts))
+	var wg sync.WaitGroup
+	for i, ctx := range contexts {
+		wg.Add(1)
+		go func(i int, ctx MessageContext) {
+			defer wg.Done()
+			msg, data, err := r.render(ctx)
+			results[i] = matchResult{msg, data, err}
+		}(i, ctx)
+	}
+	wg.Wait()
+	// Collect the successful responses
+	var rendered []matchResult
+	var firstErr error
+	for i, result := range results {
+		if result.err != nil {
+			log.WithFields(log.Fields{
+				"command": r.Name,
+				"match":   contexts[i].Groups[0],
+				"error":   result.err,
+			}).Error("REST request for match failed")
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		rendered = append(rendered, result)
+	}
+	if len(rendered) == 0 {
+		if firstErr != nil {
+			r.sendErrorMessage(bot, evt)
+		}
+		return firstErr
+	}
+	if r.MatchMode == "separate" {
+		for _, result := range rendered {
+			err := r.actions.perform(bot, evt, result.msg, result.data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Combine everything into one message, within Discord's limits
+	msg := &discordgo.MessageSend{
+		Components: r.components,
+	}
+	var contents []string
+	var data []interface{}
+	for _, result := range rendered {
+		if len(result.msg.Content) > 0 {
+			contents = append(contents, result.msg.Content)
+		}
+		for _, embed := range result.msg.Embeds {
+			if len(msg.Embeds) < maxMessageEmbeds {
+				msg.Embeds = append(msg.Embeds, embed)
+			}
+		}
+		for _, file := range result.msg.Files {
+			if len(msg.Files) < maxMessageFiles {
+				msg.Files = append(msg.Files, file)
+			}
+		}
+		data = append(data, result.data)
+	}
+	msg.Content = truncate(maxMessageLength, strings.Join(contents, "\n"))
+	return r.actions.perform(bot, evt, msg, data)
+}
+
+// fetch builds and sends a request, retrying it if necessary, and makes sure it didn't fail.
+// The caller has to close the response body.
+func (r RESTCommand) fetch(req *restRequest, ctx MessageContext) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		// Construct the request from the message
+		// (every attempt, since the body can only be read once)
+		request, err := req.build(ctx)
+		if err != nil {
+			return nil, err
+		}
+		endpoint := request.URL.String()
+		// Don't bother if the endpoint has been failing
+		var breaker *circuitBreaker
+		if r.breakerFailures > 0 {
+			breaker = getBreaker(req.breakerKey)
+			err = breaker.allow(r.breakerCooldown)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Log that we're about to send the request, in case someone's trying something nasty
+		log.WithFields(log.Fields{
+			"endpoint": endpoint,
+			"method":   request.Method,
+			"attempt":  attempt + 1,
+		}).Info("Making HTTP request")
+		// Send request
+		resp, err := r.client.Do(request)
+		if breaker != nil {
+			breaker.record(err == nil && resp.StatusCode < 500, r.breakerFailures)
+		}
+		if err == nil {
+			// Log some response metadata, again, in case someone's being nasty
+			fields := log.Fields{
+				"endpoint": endpoint,
+				"response": resp.Status,
+				"cache":    cacheStatus(resp),
+			}
+			if breaker != nil {
+				fields["breaker"] = breaker.status()
+			}
+			log.WithFields(fields).Info("HTTP request result")
+		}
+		// Retry if it's worth it and we have retries left
+		if attempt < r.retry.retries && r.retry.allows(request.Method) && shouldRetry(resp, err) {
+			delay := r.retry.delay(attempt, resp)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			log.WithFields(log.Fields{
+				"endpoint": endpoint,
+				"attempt":  attempt + 1,
+				"delay":    delay.String(),
+			}).Warn("Retrying HTTP request")
+			time.Sleep(delay)
+			continue
+		}
+		// Ensure nothing failed
+		if err != nil {
+			return nil, errors.New("could not make request: " + err.Error())
+		}
+		if resp.StatusCode >= 400 {
+			err = errors.New("request failed with status " + resp.Status)
+			if req.parseError != nil {
+				body, readErr := ioutil.ReadAll(resp.Body)
+				if bodyErr := req.parseError(body); readErr == nil && bodyErr != nil {
+					err = errors.New("request failed with status " + resp.Status + ": " + bodyErr.Error())
+				}
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusUnauthorized {
+				req.authRejected()
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// runStep runs a step that isn't the last one, returning its parsed response.
+func (r RESTCommand) runStep(step restStep, ctx MessageContext) (interface{}, error) {
+	resp, err := r.fetch(step.request, ctx)
 	if err != nil {
-		r.sendErrorMessage(bot, evt)
-		return errors.New("could not make request: " + err.Error())
-	}
-	// Log some response metadata, again, in case someone's being nasty
-	log.WithFields(log.Fields{
-		"endpoint": endpoint,
-		"response": resp.Status,
-	}).Info("HTTP request result")
-	if resp.StatusCode >= 400 {
-		r.sendErrorMessage(bot, evt)
-		return errors.New("request failed with status " + resp.Status)
+		return nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		r.sendErrorMessage(bot, evt)
-		return errors.New("could not read request body: " + err.Error())
+		return nil, errors.New("could not read request body: " + err.Error())
 	}
-	// Unmarshal the response JSON into an interface{}
-	var bodyjson interface{}
-	err = json.Unmarshal(body, &bodyjson)
+	data, err := step.parser.parse(body, resp.Header.Get("Content-Type"))
 	if err != nil {
-		r.sendErrorMessage(bot, evt)
-		return errors.New("could not unmarshal request body: " + err.Error())
+		return nil, errors.New("could not parse request body: " + err.Error())
+	}
+	return data, nil
+}
+
+// stepError says which step an error happened in, for chained commands.
+func (r RESTCommand) stepError(i int, err error) error {
+	if len(r.steps) == 1 {
+		return err
+	}
+	return errors.New("step " + strconv.Itoa(i+1) + " (" + r.steps[i].name + ") failed: " + err.Error())
+}
+
+// render makes the requests for a message and renders the response,
+// returning the message to send and the data it was rendered with.
+func (r RESTCommand) render(ctx MessageContext) (msg *discordgo.MessageSend, data interface{}, err error) {
+	// Run every step but the last, so later steps can use their results
+	last := len(r.steps) - 1
+	ctx.Steps = make(map[string]interface{})
+	for i, step := range r.steps[:last] {
+		data, err := r.runStep(step, ctx)
+		if err != nil {
+			return nil, nil, r.stepError(i, err)
+		}
+		ctx.Steps[step.name] = data
+		ctx.Results = append(ctx.Results, data)
 	}
-	msgbuf := new(bytes.Buffer)
-	err = r.template.Execute(msgbuf, bodyjson)
+	// Run the last step, whose response is actually sent
+	final := r.steps[last]
+	resp, err := r.fetch(final.request, ctx)
 	if err != nil {
-		r.sendErrorMessage(bot, evt)
-		return errors.New("could not execute template: " + err.Error())
+		return nil, nil, r.stepError(last, err)
+	}
+	defer resp.Body.Close()
+	msg = &discordgo.MessageSend{
+		Components: r.components,
+	}
+	if r.attachment != nil && r.attachment.url == nil {
+		// The body is the attachment, so there's nothing to parse
+		file, actx, err := r.attachment.fromBody(ctx, resp)
+		if err != nil {
+			return nil, nil, r.stepError(last, errors.New("could not attach response: "+err.Error()))
+		}
+		msg.Files = []*discordgo.File{file}
+		data = actx
+	} else {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil, r.stepError(last, errors.New("could not read request body: "+err.Error()))
+		}
+		// Parse the response into something templates can use
+		data, err = final.parser.parse(body, resp.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, nil, r.stepError(last, errors.New("could not parse request body: "+err.Error()))
+		}
+		// Chained commands' templates see every step's results, not just the last one's
+		if len(r.steps) > 1 {
+			ctx.Steps[final.name] = data
+			ctx.Results = append(ctx.Results, data)
+			data = ctx
+		}
+		// Download the attachment it points to, if any
+		if r.attachment != nil {
+			file, _, err := r.attachment.download(r.client, ctx, data)
+			if err != nil {
+				return nil, nil, err
+			}
+			msg.Files = []*discordgo.File{file}
+		}
+	}
+	if r.template != nil {
+		msg.Content, err = executeTemplate(r.template, data)
+		if err != nil {
+			return nil, nil, errors.New("could not execute template: " + err.Error())
+		}
 	}
-	bot.ChannelMessageSend(evt.Message.ChannelID, msgbuf.String())
-	return nil
+	if r.embed != nil {
+		embed, err := r.embed.render(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg.Embeds = []*discordgo.MessageEmbed{embed}
+	}
+	return msg, data, nil
+}
+
+// getComponents returns the component config, so the handler can route interactions.
+func (r RESTCommand) getComponents() [][]ComponentConfig {
+	return r.Components
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bwmarrin/discordgo" // for running the bot
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// RESTAttachmentConfig configures a RESTCommand to send a file instead of (or along with) text.
+type RESTAttachmentConfig struct {
+	// Template for the URL to download the file from, executed with the parsed response.
+	// If unset, the response body itself is the file.
+	URL string `json:"url"`
+	// Template for the file's name, executed with an AttachmentContext.
+	// Defaults to "attachment" with an extension based on the content type,
+	// which is also used if the template renders an empty name.
+	// Embeds can show an attached image with "attachment://<filename>".
+	Filename string `json:"filename"`
+	// Content types the file is allowed to have, e.g. "image/png" or "image/*".
+	// If unset, any content type is allowed.
+	ContentTypes []string `json:"contenttypes"`
+	// Maximum size of the file in bytes. Defaults to (and can't be more than) Discord's upload limit.
+	MaxSize int64 `json:"maxsize"`
+}
+
+// AttachmentContext is the data filename templates get, and what the response templates
+// get when the response body is the attachment.
+type AttachmentContext struct {
+	// The triggering message.
+	Message MessageContext
+	// Parsed response, if the file was downloaded from a URL in it.
+	Data interface{}
+	// Content type of the file.
+	ContentType string
+	// Extension for the content type, including the dot, or empty if unknown.
+	Extension string
+	// Name of the file. Empty when rendering the filename.
+	Filename string
+	// Size of the file in bytes.
+	Size int
+}
+
+// restAttachment is a compiled RESTAttachmentConfig.
+type restAttachment struct {
+	url          *template.Template
+	filename     *template.Template
+	contentTypes []string
+	maxSize      int64
+}
+
+// newRESTAttachment compiles a RESTAttachmentConfig.
+func newRESTAttachment(name string, config RESTAttachmentConfig) (attachment *restAttachment, err error) {
+	attachment = &restAttachment{
+		contentTypes: config.ContentTypes,
+		maxSize:      config.MaxSize,
+	}
+	if attachment.maxSize <= 0 || attachment.maxSize > uploadLimit {
+		attachment.maxSize = uploadLimit
+	}
+	if len(config.URL) > 0 {
+		attachment.url, err = newTemplate(name+" attachment url", config.URL)
+		if err != nil {
+			return nil, errors.New("Failed to compile attachment url template: " + err.Error())
+		}
+	}
+	if len(config.Filename) > 0 {
+		attachment.filename, err = newTemplate(name+" attachment filename", config.Filename)
+		if err != nil {
+			return nil, errors.New("Failed to compile attachment filename template: " + err.Error())
+		}
+	}
+	return attachment, nil
+}
+
+// readLimited reads a body, failing if it's larger than max bytes.
+func readLimited(body io.Reader, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errors.New("response is larger than the limit of " + strconv.FormatInt(max, 10) + " bytes")
+	}
+	return data, nil
+}
+
+// checkContentType checks a content type against the allowed ones.
+func (a *restAttachment) checkContentType(contentType string) error {
+	if len(a.contentTypes) == 0 {
+		return nil
+	}
+	for _, allowed := range a.contentTypes {
+		if allowed == contentType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*"))) {
+			return nil
+		}
+	}
+	return errors.New("content type " + contentType + " is not allowed")
+}
+
+// newFile checks the file's content type and builds the file to attach.
+func (a *restAttachment) newFile(ctx AttachmentContext, header string, data []byte) (*discordgo.File, AttachmentContext, error) {
+	contentType, _, err := mime.ParseMediaType(header)
+	if err != nil || contentType == "application/octet-stream" {
+		// sniff it if the server didn't tell us
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	err = a.checkContentType(contentType)
+	if err != nil {
+		return nil, ctx, err
+	}
+	ctx.ContentType = contentType
+	ctx.Size = len(data)
+	if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+		ctx.Extension = extensions[0]
+	}
+	defaultName := "attachment" + ctx.Extension
+	filename := defaultName
+	if a.filename != nil {
+		filename, err = executeTemplate(a.filename, ctx)
+		if err != nil {
+			return nil, ctx, errors.New("could not execute attachment filename template: " + err.Error())
+		}
+		// only keep the last path element, so nobody gets clever with slashes
+		filename = path.Base(strings.TrimSpace(filename))
+		// and fall back to the default if there's no name left
+		// (path.Base makes an empty name ".")
+		switch filename {
+		case ".", "..", "/":
+			filename = defaultName
+		}
+	}
+	ctx.Filename = filename
+	return &discordgo.File{
+		Name:        filename,
+		ContentType: contentType,
+		Reader:      bytes.NewReader(data),
+	}, ctx, nil
+}
+
+// fromBody makes the response body into the attachment.
+func (a *restAttachment) fromBody(msgctx MessageContext, resp *http.Response) (*discordgo.File, AttachmentContext, error) {
+	ctx := AttachmentContext{Message: msgctx}
+	data, err := readLimited(resp.Body, a.maxSize)
+	if err != nil {
+		return nil, ctx, err
+	}
+	return a.newFile(ctx, resp.Header.Get("Content-Type"), data)
+}
+
+// download renders the attachment URL from the parsed response and downloads the attachment from it.
+func (a *restAttachment) download(client *http.Client, msgctx MessageContext, parsed interface{}) (*discordgo.File, AttachmentContext, error) {
+	ctx := AttachmentContext{Message: msgctx, Data: parsed}
+	url, err := executeTemplate(a.url, parsed)
+	if err != nil {
+		return nil, ctx, errors.New("could not execute attachment url template: " + err.Error())
+	}
+	url = strings.TrimSpace(url)
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, ctx, errors.New("attachment url " + url + " is not an http(s) URL")
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, ctx, errors.New("could not download attachment: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, ctx, errors.New("attachment download failed with status " + resp.Status)
+	}
+	if resp.ContentLength > a.maxSize {
+		return nil, ctx, errors.New("attachment is larger than the limit of " + strconv.FormatInt(a.maxSize, 10) + " bytes")
+	}
+	data, err := readLimited(resp.Body, a.maxSize)
+	if err != nil {
+		return nil, ctx, err
+	}
+	return a.newFile(ctx, resp.Header.Get("Content-Type"), data)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"  // for running the bot
+	log "github.com/sirupsen/logrus" // logging suite
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Limits for REST watchers.
+const (
+	defaultWatchInterval = 5 * time.Minute
+	minWatchInterval     = 10 * time.Second
+	// How many new items are announced per poll by default.
+	defaultWatchMaxItems = 5
+	// How many item keys are remembered, so items that drop off a list and come back
+	// aren't announced again. Keys of items still in the list are always remembered.
+	watchSeenLimit = 1000
+)
+
+// RESTWatchCommand polls an endpoint, and posts to channels when its data changes.
+// It isn't triggered by messages.
+type RESTWatchCommand struct {
+	BaseCommand
+	RESTWatchConfig
+	rest     RESTCommand
+	interval time.Duration
+	value    *template.Template
+	itemKey  *template.Template
+	poller   background
+}
+
+// RESTWatchConfig is the configuration for the RESTWatchCommand.
+// The request is configured like a REST command's (endpoint, headers, auth, response format
+// and so on), and the response template and embed are used for the announcements.
+// They get a WatchContext.
+type RESTWatchConfig struct {
+	RESTConfig
+	// How often to poll, e.g. "5m". Defaults to 5 minutes, and can't be less than 10 seconds.
+	Interval string `json:"interval"`
+	// IDs of the channels to post in.
+	Channels []string `json:"channels"`
+	// Template that extracts the value to watch from the parsed response, e.g. "{{.status}}".
+	// An announcement is posted whenever it changes.
+	Value string `json:"value"`
+	// Path to a list in the parsed response to watch for new items, e.g. "data.releases".
+	// An announcement is posted for every new item. Can't be used with value.
+	Items string `json:"items"`
+	// Template that identifies an item, e.g. "{{.id}}". Defaults to the whole item.
+	ItemKey string `json:"itemkey"`
+	// Maximum number of new items to announce per poll. Defaults to 5.
+	MaxItems int `json:"maxitems"`
+}
+
+// WatchContext is the data a watcher's announcements are rendered with.
+type WatchContext struct {
+	// The new value, for value watchers.
+	Value string
+	// The value before it changed, for value watchers.
+	Previous string
+	// The new item, for item watchers.
+	Item interface{}
+	// The whole parsed response.
+	Data interface{}
+	// Time the change was seen.
+	Now time.Time
+	// Key of the new item, for item watchers.
+	key string
+}
+
+// watchState is what a watcher remembers between polls, and restarts.
+type watchState struct {
+	Value string   `json:"value,omitempty"`
+	Seen  []string `json:"seen,omitempty"`
+}
+
+// NewRESTWatchCommand generates a new RESTWatchCommand.
+func NewRESTWatchCommand(config BaseCommand) (command *RESTWatchCommand, err error) {
+	var options RESTWatchConfig
+	err = json.Unmarshal(config.Options, &options)
+	if err != nil {
+		return nil, err
+	}
+	command = &RESTWatchCommand{
+		BaseCommand:     config,
+		RESTWatchConfig: options,
+		interval:        defaultWatchInterval,
+	}
+	if len(options.Interval) > 0 {
+		command.interval, err = time.ParseDuration(options.Interval)
+		if err != nil {
+			return nil, errors.New("Invalid interval: " + err.Error())
+		}
+		if command.interval < minWatchInterval {
+			return nil, errors.New("interval cannot be less than " + minWatchInterval.String())
+		}
+	}
+	if len(options.Channels) == 0 {
+		return nil, errors.New("restwatch commands need at least one channel")
+	}
+	if len(options.Steps) > 0 || options.AllMatches {
+		return nil, errors.New("restwatch commands cannot have steps or allmatches")
+	}
+	if len(options.Response) == 0 && len(options.ResponseFilepath) == 0 && options.Embed == nil {
+		return nil, errors.New("restwatch commands need a response or an embed")
+	}
+	// Set up what's watched
+	switch {
+	case len(options.Value) > 0 && len(options.Items) > 0:
+		return nil, errors.New("Can only have one of value and items")
+	case len(options.Value) > 0:
+		command.value, err = newTemplate(config.Name+" value", options.Value)
+		if err != nil {
+			return nil, errors.New("Failed to compile value template: " + err.Error())
+		}
+	case len(options.Items) > 0:
+		if len(options.ItemKey) > 0 {
+			command.itemKey, err = newTemplate(config.Name+" itemkey", options.ItemKey)
+			if err != nil {
+				return nil, errors.New("Failed to compile itemkey template: " + err.Error())
+			}
+		}
+	default:
+		return nil, errors.New("restwatch commands need a value or items to watch")
+	}
+	if options.MaxItems < 0 {
+		return nil, errors.New("maxitems cannot be negative")
+	}
+	if options.MaxItems == 0 {
+		command.MaxItems = defaultWatchMaxItems
+	}
+	// The request itself works like a REST command's
+	command.rest, err = newRESTCommand(config, options.RESTConfig)
+	if err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// Test always fails, since watchers aren't triggered by messages.
+func (w *RESTWatchCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate) bool {
+	return false
+}
+
+// Run does nothing, since watchers aren't triggered by messages.
+func (w *RESTWatchCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) error {
+	return nil
+}
+
+// getComponents returns the component config, so the handler can route interactions.
+func (w *RESTWatchCommand) getComponents() [][]ComponentConfig {
+	return w.Components
+}
+
+// start starts polling.
+func (w *RESTWatchCommand) start(bot *discordgo.Session) {
+	w.poller.poll(w.interval, func() { w.poll(bot) })
+}
+
+// stop stops polling, waiting for a poll in progress to finish.
+func (w *RESTWatchCommand) stop() {
+	w.poller.stop()
+}
+
+// stateKey is the key the watcher's state is stored under.
+func (w *RESTWatchCommand) stateKey() string {
+	return "restwatch/" + w.Name
+}
+
+// poll checks the endpoint, and posts about any changes.
+func (w *RESTWatchCommand) poll(bot *discordgo.Session) {
+	fields := log.Fields{
+		"command": w.Name,
+	}
+	// Hold the state while we work, in case another watcher with the same name
+	// (i.e. this one before a reload) is polling too
+	unlock := botState.lock(w.stateKey())
+	defer unlock()
+	var state watchState
+	found, err := botState.get(w.stateKey(), &state)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Could not load watcher state")
+		return
+	}
+	data, err := w.rest.runStep(w.rest.steps[0], MessageContext{
+		Named: make(map[string]string),
+		Now:   time.Now(),
+	})
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Watcher request failed")
+		return
+	}
+	var changes []WatchContext
+	// Keys of the items in the list, for item watchers
+	var current map[string]bool
+	if w.value != nil {
+		changes, err = w.valueChanges(state, data)
+	} else {
+		changes, current, err = w.itemChanges(state, data)
+	}
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Watcher could not check for changes")
+		return
+	}
+	// The first poll just records where things are, rather than announcing everything
+	if !found {
+		for _, change := range changes {
+			w.record(&state, change)
+		}
+		changes = nil
+		log.WithFields(fields).Info("Watcher started tracking")
+	}
+	// Only what's actually announced is recorded, so anything that fails to post,
+	// or is over the limit for this poll, is tried again next time
+	if len(changes) > w.MaxItems {
+		changes = changes[:w.MaxItems]
+	}
+	announced := 0
+	for _, change := range changes {
+		err = w.announce(bot, change)
+		if err != nil {
+			log.WithFields(fields).WithField("error", err).Error("Watcher could not announce change")
+			continue
+		}
+		w.record(&state, change)
+		announced++
+	}
+	state.Seen = trimSeen(state.Seen, current)
+	if announced > 0 {
+		log.WithFields(fields).WithField("changes", announced).Info("Watcher announced changes")
+	}
+	if !found || announced > 0 {
+		err = botState.set(w.stateKey(), state)
+		if err != nil {
+			log.WithFields(fields).WithField("error", err).Error("Could not save watcher state")
+		}
+	}
+}
+
+// valueChanges checks if the watched value changed.
+func (w *RESTWatchCommand) valueChanges(state watchState, data interface{}) ([]WatchContext, error) {
+	value, err := executeTemplate(w.value, data)
+	if err != nil {
+		return nil, errors.New("could not execute value template: " + err.Error())
+	}
+	value = strings.TrimSpace(value)
+	if value == state.Value {
+		return nil, nil
+	}
+	change := WatchContext{
+		Value:    value,
+		Previous: state.Value,
+		Data:     data,
+		Now:      time.Now(),
+	}
+	return []WatchContext{change}, nil
+}
+
+// itemChanges finds items that haven't been seen before.
+// It also returns the keys of every item in the list.
+func (w *RESTWatchCommand) itemChanges(state watchState, data interface{}) ([]WatchContext, map[string]bool, error) {
+	list, err := toList(lookupPath(data, w.Items))
+	if err != nil {
+		return nil, nil, errors.New("items is not a list: " + err.Error())
+	}
+	seen := make(map[string]bool, len(state.Seen))
+	for _, key := range state.Seen {
+		seen[key] = true
+	}
+	current := make(map[string]bool, len(list))
+	var changes []WatchContext
+	for _, item := range list {
+		key, err := w.key(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		current[key] = true
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		changes = append(changes, WatchContext{
+			Item: item,
+			Data: data,
+			Now:  time.Now(),
+			key:  key,
+		})
+	}
+	return changes, current, nil
+}
+
+// record updates the state with a change, so it isn't announced again.
+func (w *RESTWatchCommand) record(state *watchState, change WatchContext) {
+	if w.value != nil {
+		state.Value = change.Value
+		return
+	}
+	state.Seen = append(state.Seen, change.key)
+}
+
+// trimSeen forgets the oldest item keys once there are more than watchSeenLimit,
+// except for the keys of items still in the list, which would be announced again.
+// So for lists longer than the limit, every key in the list is kept.
+func trimSeen(seen []string, current map[string]bool) []string {
+	excess := len(seen) - watchSeenLimit
+	if excess <= 0 {
+		return seen
+	}
+	kept := make([]string, 0, len(seen)-excess)
+	for _, key := range seen {
+		if excess > 0 && !current[key] {
+			excess--
+			continue
+		}
+		kept = append(kept, key)
+	}
+	return kept
+}
+
+// key identifies an item.
+func (w *RESTWatchCommand) key(item interface{}) (string, error) {
+	if w.itemKey == nil {
+		b, err := json.Marshal(item)
+		return string(b), err
+	}
+	key, err := executeTemplate(w.itemKey, item)
+	if err != nil {
+		return "", errors.New("could not execute itemkey template: " + err.Error())
+	}
+	return strings.TrimSpace(key), nil
+}
+
+// announce renders a change and posts it to the watcher's channels.
+func (w *RESTWatchCommand) announce(bot *discordgo.Session, change WatchContext) error {
+	msg, err := renderMessage(w.rest.template, w.rest.embed, change)
+	if err != nil {
+		return err
+	}
+	msg.Components = w.rest.components
+	return sendToChannels(bot, w.Channels, msg)
+}
+
+// lookupPath finds the value at a dot-separated path in parsed data,
+// e.g. "data.items.0.name". An empty path is the data itself.
+func lookupPath(data interface{}, path string) interface{} {
+	if len(path) == 0 {
+		return data
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			data = v[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			data = v[i]
+		default:
+			return nil
+		}
+	}
+	return data
+}
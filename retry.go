@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus" // logging suite
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for RESTCommand's HTTP behavior.
+const (
+	defaultRequestTimeout = 15 * time.Second
+	defaultRetryBackoff   = 500 * time.Millisecond
+	// Longest we'll ever wait between retries, whatever the backoff or Retry-After says.
+	maxRetryDelay = 30 * time.Second
+	// Most retries a request can have.
+	maxRetries             = 10
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = time.Minute
+)
+
+// Circuit breaker states.
+const (
+	// Requests go through as normal.
+	breakerStateClosed = "closed"
+	// Requests fail straight away until the cooldown is over.
+	breakerStateOpen = "open"
+	// The cooldown is over, and a test request is deciding whether to close or reopen the breaker.
+	breakerStateHalfOpen = "half-open"
+)
+
+// CircuitBreakerConfig configures the circuit breaker for a RESTCommand's endpoints.
+type CircuitBreakerConfig struct {
+	// Number of failures in a row (connection errors or 5xx responses) that open the breaker.
+	// Defaults to 5.
+	Failures int `json:"failures"`
+	// How long the breaker stays open before letting a request through to test the endpoint,
+	// e.g. "1m". Defaults to one minute.
+	Cooldown string `json:"cooldown"`
+}
+
+// retryPolicy is how a RESTCommand retries failed requests.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	// Whether to retry requests that aren't idempotent too.
+	unsafe bool
+}
+
+// idempotentMethods are the methods retried by default. A failed request
+// may still have reached the server, so retrying anything else risks doing it twice.
+// PUT and DELETE are idempotent in theory, but plenty of APIs get that wrong.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// allows checks if the policy retries requests with the given method.
+func (p retryPolicy) allows(method string) bool {
+	return p.unsafe || idempotentMethods[method]
+}
+
+// delay returns how long to wait before retrying after the given attempt (starting at 0),
+// respecting the response's Retry-After header if there is one.
+func (p retryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	// double the backoff for each attempt, stopping at the cap so it can't overflow
+	delay := p.backoff
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	// add up to 20% jitter, so retries from different messages don't line up
+	delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	if resp != nil {
+		if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > 0 {
+			delay = retryAfter
+		}
+	}
+	if delay > maxRetryDelay || delay < 0 {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// parseRetryAfter parses a Retry-After header, which is either seconds or an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if len(header) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// shouldRetry checks if a request should be retried: connection errors,
+// server errors and rate limits are worth another try, anything else isn't.
+func shouldRetry(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// circuitBreaker stops requests to an endpoint after it fails too many times in a row.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	endpoint string
+	state    string
+	failures int
+	openedAt time.Time
+	// Whether a half-open test request is in flight.
+	testing bool
+}
+
+// Circuit breakers, by method and endpoint template (see restRequest.breakerKey),
+// so one failing endpoint doesn't stop requests to the rest of its host.
+// These are shared between commands, and survive reloads.
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker)
+)
+
+// getBreaker gets the circuit breaker for an endpoint.
+func getBreaker(endpoint string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	breaker, ok := breakers[endpoint]
+	if !ok {
+		breaker = &circuitBreaker{endpoint: endpoint, state: breakerStateClosed}
+		breakers[endpoint] = breaker
+	}
+	return breaker
+}
+
+// setState changes the breaker's state, logging it. Must be called with mu held.
+func (b *circuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	log.WithFields(log.Fields{
+		"endpoint": b.endpoint,
+		"from":     b.state,
+		"to":       state,
+		"failures": b.failures,
+	}).Warn("Circuit breaker state changed")
+	b.state = state
+}
+
+// allow checks if a request can go through. Once the cooldown has passed on an open breaker,
+// a single test request is let through to see if the endpoint is back.
+func (b *circuitBreaker) allow(cooldown time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerStateOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return errors.New("circuit breaker for " + b.endpoint + " is open, not making request")
+		}
+		b.setState(breakerStateHalfOpen)
+		b.testing = true
+	case breakerStateHalfOpen:
+		if b.testing {
+			return errors.New("circuit breaker for " + b.endpoint + " is testing the endpoint, not making request")
+		}
+		b.testing = true
+	}
+	return nil
+}
+
+// record records the result of a request.
+func (b *circuitBreaker) record(success bool, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.testing = false
+	if success {
+		b.failures = 0
+		b.setState(breakerStateClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerStateHalfOpen || b.failures >= threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerStateOpen)
+	}
+}
+
+// status gets the breaker's current state, for logging.
+func (b *circuitBreaker) status() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/bclindner/iasipgenerator/iasipgen"
+	"github.com/bwmarrin/discordgo"  // for running the bot
+	log "github.com/sirupsen/logrus" // logging suite
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Things a scheduled command can do.
+const (
+	// Post a templated message. This is the default.
+	scheduleMessage = "message"
+	// Run a REST lookup and post its response.
+	scheduleREST = "rest"
+	// Post an IASIP title card.
+	scheduleIASIP = "iasip"
+)
+
+// ScheduleCommand posts to channels on a cron schedule.
+// It isn't triggered by messages.
+type ScheduleCommand struct {
+	BaseCommand
+	ScheduleConfig
+	cron     *cronSchedule
+	location *time.Location
+	template *template.Template
+	embed    *embedTemplate
+	rest     *RESTCommand
+	runner   background
+}
+
+// ScheduleConfig is the configuration for the ScheduleCommand.
+type ScheduleConfig struct {
+	// When to run, as a cron expression (minute, hour, day of month, month, day of week),
+	// e.g. "0 9 * * mon-fri" for 9am on weekdays, or a shorthand like "@daily".
+	Cron string `json:"cron"`
+	// Timezone the cron expression is in, e.g. "Europe/London". Defaults to the system's.
+	Timezone string `json:"timezone"`
+	// IDs of the channels to post in.
+	Channels []string `json:"channels"`
+	// What to do: "message", "rest" or "iasip".
+	Action string `json:"action"`
+	// Template for the message, or the title card text for "iasip", executed with a ScheduleContext.
+	Response string `json:"response"`
+	// Rich embed to post, for "message".
+	Embed *EmbedConfig `json:"embed"`
+	// Options of the REST lookup, for "rest". This is the same as the options of a "rest" command;
+	// its templates get a MessageContext with only Now set.
+	REST json.RawMessage `json:"rest"`
+	// Path to the title card font, for "iasip".
+	FontPath string `json:"fontpath"`
+	// JPEG quality of the title card, for "iasip".
+	ImageQuality int `json:"quality"`
+	// If the bot was down when the command should have run, run it once when the bot starts,
+	// for the latest time it was missed. Otherwise, missed runs are skipped.
+	CatchUp bool `json:"catchup"`
+}
+
+// ScheduleContext is the data scheduled messages are rendered with.
+type ScheduleContext struct {
+	// Time the command was scheduled to run, in its timezone.
+	Scheduled time.Time
+	// Time it actually ran.
+	Now time.Time
+}
+
+// scheduleState is what a schedule remembers across restarts.
+type scheduleState struct {
+	// The scheduled time of the last run.
+	LastRun time.Time `json:"lastRun"`
+}
+
+// NewScheduleCommand generates a new ScheduleCommand.
+func NewScheduleCommand(config BaseCommand) (command *ScheduleCommand, err error) {
+	var options ScheduleConfig
+	err = json.Unmarshal(config.Options, &options)
+	if err != nil {
+		return nil, err
+	}
+	command = &ScheduleCommand{
+		BaseCommand:    config,
+		ScheduleConfig: options,
+		location:       time.Local,
+	}
+	command.cron, err = parseCron(options.Cron)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.Timezone) > 0 {
+		command.location, err = time.LoadLocation(options.Timezone)
+		if err != nil {
+			return nil, errors.New("Invalid timezone: " + err.Error())
+		}
+	}
+	if command.cron.next(time.Now().In(command.location)).IsZero() {
+		return nil, errors.New("cron expression " + options.Cron + " never runs")
+	}
+	if len(options.Channels) == 0 {
+		return nil, errors.New("scheduled commands need at least one channel")
+	}
+	if len(options.Response) > 0 {
+		command.template, err = newTemplate(config.Name, options.Response)
+		if err != nil {
+			return nil, errors.New("Failed to compile template: " + err.Error())
+		}
+	}
+	switch options.Action {
+	case "", scheduleMessage:
+		command.Action = scheduleMessage
+		if command.template == nil && options.Embed == nil {
+			return nil, errors.New("scheduled messages need a response or an embed")
+		}
+		if options.Embed != nil {
+			command.embed, err = newEmbedTemplate(config.Name, *options.Embed)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case scheduleREST:
+		rest, err := NewRESTCommand(BaseCommand{
+			Name:    config.Name + "/rest",
+			Type:    "rest",
+			Options: options.REST,
+		})
+		if err != nil {
+			return nil, errors.New("Error with rest options: " + err.Error())
+		}
+		command.rest = &rest
+	case scheduleIASIP:
+		if command.template == nil {
+			return nil, errors.New("scheduled title cards need a response")
+		}
+		err = iasipgen.LoadFont(options.FontPath)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Invalid action " + options.Action)
+	}
+	return command, nil
+}
+
+// Test always fails, since scheduled commands aren't triggered by messages.
+func (s *ScheduleCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate) bool {
+	return false
+}
+
+// Run does nothing, since scheduled commands aren't triggered by messages.
+func (s *ScheduleCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) error {
+	return nil
+}
+
+// stateKey is the key the schedule's state is stored under.
+func (s *ScheduleCommand) stateKey() string {
+	return "schedule/" + s.Name
+}
+
+// start starts the schedule, catching up on a missed run first if configured to.
+func (s *ScheduleCommand) start(bot *discordgo.Session) {
+	s.runner.run(func(stopping <-chan struct{}) {
+		now := time.Now().In(s.location)
+		s.catchUp(bot, now)
+		next := s.cron.next(now)
+		for !next.IsZero() {
+			// wake up at least once a minute, in case the clock jumps
+			wait := time.Until(next)
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-stopping:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if time.Now().Before(next) {
+				continue
+			}
+			s.fire(bot, next)
+			// runs that were missed while this one ran are skipped
+			next = s.cron.next(time.Now().In(s.location))
+		}
+	})
+}
+
+// stop stops the schedule, waiting for a run in progress to finish.
+func (s *ScheduleCommand) stop() {
+	s.runner.stop()
+}
+
+// catchUp runs the command if a run was missed while the bot was down, and catching up is on.
+// It also records that the schedule is running, so later downtime can be noticed.
+func (s *ScheduleCommand) catchUp(bot *discordgo.Session, now time.Time) {
+	unlock := botState.lock(s.stateKey())
+	var state scheduleState
+	found, err := botState.get(s.stateKey(), &state)
+	if err == nil && !found {
+		err = botState.set(s.stateKey(), scheduleState{LastRun: now})
+	}
+	unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"command": s.Name,
+			"error":   err,
+		}).Error("Could not load schedule state")
+		return
+	}
+	if !found || !s.CatchUp {
+		return
+	}
+	// only the latest missed run is caught up on, since that's the one that's still current
+	var missed time.Time
+	for next := s.cron.next(state.LastRun.In(s.location)); !next.IsZero() && next.Before(now); next = s.cron.next(next) {
+		missed = next
+	}
+	if !missed.IsZero() {
+		log.WithFields(log.Fields{
+			"command":   s.Name,
+			"scheduled": missed,
+		}).Info("Catching up on missed scheduled run")
+		s.fire(bot, missed)
+	}
+}
+
+// fire runs the command for a scheduled time, unless it's already run for it
+// (e.g. by the same schedule before a reload).
+func (s *ScheduleCommand) fire(bot *discordgo.Session, scheduled time.Time) {
+	fields := log.Fields{
+		"command":   s.Name,
+		"action":    s.Action,
+		"scheduled": scheduled,
+	}
+	unlock := botState.lock(s.stateKey())
+	defer unlock()
+	var state scheduleState
+	_, err := botState.get(s.stateKey(), &state)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Could not load schedule state")
+		return
+	}
+	if !state.LastRun.Before(scheduled) {
+		return
+	}
+	log.WithFields(fields).Info("Scheduled command fired")
+	err = s.run(bot, scheduled)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Scheduled command failed")
+	}
+	// record the run even if it failed, so it isn't retried over and over
+	err = botState.set(s.stateKey(), scheduleState{LastRun: scheduled})
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Could not save schedule state")
+	}
+}
+
+// run builds the message for a scheduled time and posts it.
+func (s *ScheduleCommand) run(bot *discordgo.Session, scheduled time.Time) (err error) {
+	ctx := ScheduleContext{
+		Scheduled: scheduled,
+		Now:       time.Now().In(s.location),
+	}
+	var msg *discordgo.MessageSend
+	switch s.Action {
+	case scheduleMessage:
+		msg, err = renderMessage(s.template, s.embed, ctx)
+		if err != nil {
+			return err
+		}
+	case scheduleREST:
+		msg, _, err = s.rest.render(MessageContext{
+			Named: make(map[string]string),
+			Now:   ctx.Now,
+		})
+		if err != nil {
+			return err
+		}
+	case scheduleIASIP:
+		text, err := executeTemplate(s.template, ctx)
+		if err != nil {
+			return errors.New("could not execute template: " + err.Error())
+		}
+		card, err := renderTitleCard(strings.TrimSpace(text), s.ImageQuality)
+		if err != nil {
+			return err
+		}
+		msg = &discordgo.MessageSend{
+			Files: []*discordgo.File{{
+				Name:        "iasip.jpg",
+				ContentType: "image/jpeg",
+				Reader:      bytes.NewReader(card.Bytes()),
+			}},
+		}
+	}
+	return sendToChannels(bot, s.Channels, msg)
+}
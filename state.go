@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus" // logging suite
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultStateFile is where state is kept if the bot config doesn't set stateFile.
+const defaultStateFile = "valerius-state.json"
+
+// stateStore keeps small pieces of state that have to survive restarts,
+// like what watchers have already announced, in a JSON file.
+type stateStore struct {
+	mu sync.Mutex
+	// Path of the state file.
+	path string
+	data map[string]json.RawMessage
+	// Locks for keys, so one thing at a time can update each.
+	locks map[string]*sync.Mutex
+}
+
+// botState is the bot's state store.
+var botState = &stateStore{
+	path:  defaultStateFile,
+	locks: make(map[string]*sync.Mutex),
+}
+
+// setPath sets the path of the state file, from the stateFile in the bot config.
+// If it's changed, the new file is read the next time the state is used.
+func (s *stateStore) setPath(path string) {
+	if len(path) == 0 {
+		path = defaultStateFile
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if path != s.path {
+		s.path = path
+		s.data = nil
+	}
+}
+
+// load reads the state file if it hasn't been read yet.
+// The caller must hold s.mu.
+func (s *stateStore) load() error {
+	if s.data != nil {
+		return nil
+	}
+	data := make(map[string]json.RawMessage)
+	contents, err := ioutil.ReadFile(s.path)
+	if err == nil {
+		err = json.Unmarshal(contents, &data)
+		if err != nil {
+			return errors.New("could not parse state file: " + err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.New("could not read state file: " + err.Error())
+	}
+	s.data = data
+	return nil
+}
+
+// get decodes the state stored under a key into v, returning whether there was any.
+func (s *stateStore) get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load()
+	if err != nil {
+		return false, err
+	}
+	raw, ok := s.data[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// set stores v under a key, and saves the state file.
+func (s *stateStore) set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.load()
+	if err != nil {
+		return err
+	}
+	s.data[key] = raw
+	return s.save()
+}
+
+// save writes the state file, replacing it in one go so a crash can't leave it half-written.
+// The caller must hold s.mu.
+func (s *stateStore) save() error {
+	contents, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return errors.New("could not save state: " + err.Error())
+	}
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.New("could not save state: " + err.Error())
+	}
+	log.WithField("path", s.path).Debug("Saved state")
+	return nil
+}
+
+// lock locks a key, so whatever reads, acts on and updates its state
+// can't race with something else doing the same, e.g. an old watcher during a reload.
+// It returns the function to unlock it.
+func (s *stateStore) lock(key string) func() {
+	s.mu.Lock()
+	lock, ok := s.locks[key]
+	if !ok {
+		lock = new(sync.Mutex)
+		s.locks[key] = lock
+	}
+	s.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
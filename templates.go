@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Limits on template execution.
+const (
+	// maxTemplateOutput is the most a single template execution can output.
+	maxTemplateOutput = 256 << 10
+	// maxTemplateItems is the most items repeat and seq can produce.
+	maxTemplateItems = 10000
+)
+
+func init() {
+	// seed the RNG the template functions use
+	rand.Seed(time.Now().UnixNano())
+}
+
+// templateFuncs are the functions available to every template.
+// Functions that transform a value take it as their last argument, so they work in pipelines,
+// e.g. {{.title | truncate 50}}. These are documented in the README.
+var templateFuncs = template.FuncMap{
+	// random picks one of its arguments at random.
+	"random": func(choices ...interface{}) (interface{}, error) {
+		if len(choices) == 0 {
+			return nil, errors.New("random needs at least one argument")
+		}
+		return choices[rand.Intn(len(choices))], nil
+	},
+	// json encodes a value as JSON, for safely building JSON request bodies.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// path escapes a value for use as a URL path segment.
+	"path": url.PathEscape,
+	// query escapes a value for use in a URL query string.
+	"query": url.QueryEscape,
+	// raw outputs a value as-is. Endpoint templates escape everything
+	// they output for you; this opts out of that.
+	"raw": func(s string) string { return s },
+	// randint returns a random integer in [min, max].
+	"randint": func(min, max int) (int, error) {
+		if max < min {
+			return 0, errors.New("randint max is less than min")
+		}
+		return min + rand.Intn(max-min+1), nil
+	},
+
+	// Strings
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      strings.Title,
+	"trim":       strings.TrimSpace,
+	"trimprefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimsuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasprefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hassuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"truncate":   truncate,
+	"repeat": func(n int, s string) (string, error) {
+		if n < 0 || n*len(s) > maxTemplateOutput {
+			return "", errors.New("repeat count out of range")
+		}
+		return strings.Repeat(s, n), nil
+	},
+	"str": func(v interface{}) string { return fmt.Sprint(v) },
+
+	// Defaults
+	"default": func(def, v interface{}) interface{} {
+		if isEmpty(v) {
+			return def
+		}
+		return v
+	},
+	"empty": isEmpty,
+	"coalesce": func(values ...interface{}) interface{} {
+		for _, v := range values {
+			if !isEmpty(v) {
+				return v
+			}
+		}
+		return nil
+	},
+
+	// Math. These accept any number, including the float64s JSON decodes to, and numeric strings.
+	"add": func(a, b interface{}) (float64, error) {
+		return mathOp(a, b, func(x, y float64) float64 { return x + y })
+	},
+	"sub": func(a, b interface{}) (float64, error) {
+		return mathOp(a, b, func(x, y float64) float64 { return x - y })
+	},
+	"mul": func(a, b interface{}) (float64, error) {
+		return mathOp(a, b, func(x, y float64) float64 { return x * y })
+	},
+	"div": func(a, b interface{}) (float64, error) {
+		y, err := toFloat(b)
+		if err != nil {
+			return 0, err
+		}
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return mathOp(a, b, func(x, y float64) float64 { return x / y })
+	},
+	"mod": func(a, b interface{}) (float64, error) {
+		y, err := toFloat(b)
+		if err != nil {
+			return 0, err
+		}
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return mathOp(a, b, math.Mod)
+	},
+	"min": func(a, b interface{}) (float64, error) { return mathOp(a, b, math.Min) },
+	"max": func(a, b interface{}) (float64, error) { return mathOp(a, b, math.Max) },
+	"round": func(places int, v interface{}) (float64, error) {
+		x, err := toFloat(v)
+		if err != nil {
+			return 0, err
+		}
+		scale := math.Pow(10, float64(places))
+		return math.Round(x*scale) / scale, nil
+	},
+	"int": func(v interface{}) (int, error) {
+		x, err := toFloat(v)
+		return int(x), err
+	},
+	"float":  toFloat,
+	"number": formatNumber,
+
+	// Time
+	"now": time.Now,
+	"unix": func(v interface{}) (time.Time, error) {
+		x, err := toFloat(v)
+		return time.Unix(int64(x), 0), err
+	},
+	"parsetime": func(layout, value string) (time.Time, error) {
+		return time.Parse(timeLayout(layout), value)
+	},
+	"formattime": func(layout string, t time.Time) string {
+		return t.Format(timeLayout(layout))
+	},
+	"since": func(t time.Time) time.Duration {
+		return time.Since(t).Round(time.Second)
+	},
+	"duration": func(v interface{}) (time.Duration, error) {
+		x, err := toFloat(v)
+		return time.Duration(x * float64(time.Second)).Round(time.Second), err
+	},
+
+	// Collections
+	"list": func(values ...interface{}) []interface{} { return values },
+	"dict": func(pairs ...interface{}) (map[string]interface{}, error) {
+		if len(pairs)%2 != 0 {
+			return nil, errors.New("dict needs an even number of arguments")
+		}
+		dict := make(map[string]interface{}, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			dict[fmt.Sprint(pairs[i])] = pairs[i+1]
+		}
+		return dict, nil
+	},
+	"join": func(sep string, list interface{}) (string, error) {
+		items, err := toList(list)
+		if err != nil {
+			return "", err
+		}
+		strs := make([]string, len(items))
+		for i, item := range items {
+			strs[i] = fmt.Sprint(item)
+		}
+		return strings.Join(strs, sep), nil
+	},
+	"first": func(list interface{}) (interface{}, error) {
+		items, err := toList(list)
+		if err != nil || len(items) == 0 {
+			return nil, err
+		}
+		return items[0], nil
+	},
+	"last": func(list interface{}) (interface{}, error) {
+		items, err := toList(list)
+		if err != nil || len(items) == 0 {
+			return nil, err
+		}
+		return items[len(items)-1], nil
+	},
+	"pick": func(list interface{}) (interface{}, error) {
+		items, err := toList(list)
+		if err != nil || len(items) == 0 {
+			return nil, err
+		}
+		return items[rand.Intn(len(items))], nil
+	},
+	"limit": func(n int, list interface{}) ([]interface{}, error) {
+		items, err := toList(list)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 0 && n < len(items) {
+			items = items[:n]
+		}
+		return items, nil
+	},
+	"keys": func(dict map[string]interface{}) []string {
+		keys := make([]string, 0, len(dict))
+		for key := range dict {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+	"sort": func(list interface{}) ([]string, error) {
+		items, err := toList(list)
+		if err != nil {
+			return nil, err
+		}
+		strs := make([]string, len(items))
+		for i, item := range items {
+			strs[i] = fmt.Sprint(item)
+		}
+		sort.Strings(strs)
+		return strs, nil
+	},
+	"seq": func(n int) ([]int, error) {
+		if n < 0 || n > maxTemplateItems {
+			return nil, errors.New("seq count out of range")
+		}
+		seq := make([]int, n)
+		for i := range seq {
+			seq[i] = i
+		}
+		return seq, nil
+	},
+
+	// Discord formatting
+	"mention": func(id interface{}) string { return "<@" + fmt.Sprint(id) + ">" },
+	"channel": func(id interface{}) string { return "<#" + fmt.Sprint(id) + ">" },
+	"role":    func(id interface{}) string { return "<@&" + fmt.Sprint(id) + ">" },
+	"escape":  escapeMarkdown,
+	"code":    func(s string) string { return "`" + strings.Replace(s, "`", "'", -1) + "`" },
+	"codeblock": func(lang, s string) string {
+		return "```" + lang + "\n" + strings.Replace(s, "```", "`\u200b``", -1) + "\n```"
+	},
+	"bold":    func(s string) string { return "**" + s + "**" },
+	"italic":  func(s string) string { return "*" + s + "*" },
+	"spoiler": func(s string) string { return "||" + s + "||" },
+	"quote":   func(s string) string { return "> " + strings.Replace(s, "\n", "\n> ", -1) },
+	"timestamp": func(style string, t time.Time) string {
+		return "<t:" + strconv.FormatInt(t.Unix(), 10) + ":" + style + ">"
+	},
+}
+
+// newTemplate compiles a template used for command output.
+// Every template in the bot should be created through this, so they all behave the same way.
+func newTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// limitedWriter is a buffer that stops accepting writes once it's full.
+type limitedWriter struct {
+	buf   strings.Builder
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errors.New("template output is longer than " + strconv.Itoa(w.limit) + " bytes")
+	}
+	return w.buf.Write(p)
+}
+
+// executeTemplate executes a template and returns the result as a string.
+// Execution fails if the output grows past maxTemplateOutput.
+func executeTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	out := &limitedWriter{limit: maxTemplateOutput}
+	err := tmpl.Execute(out, data)
+	if err != nil {
+		return "", err
+	}
+	return out.buf.String(), nil
+}
+
+// truncate shortens a string to at most n characters, ending it with an ellipsis if it was cut.
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if n < 0 || len(runes) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(runes[:n])
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// isEmpty reports whether a value is missing or the zero value of its type.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return value.IsZero()
+}
+
+// toFloat converts a number or numeric string to a float64.
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	case json.Number:
+		return n.Float64()
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// mathOp converts both operands to numbers and applies op to them.
+func mathOp(a, b interface{}, op func(x, y float64) float64) (float64, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	return op(x, y), nil
+}
+
+// formatNumber formats a number with thousands separators and up to 2 decimal places.
+func formatNumber(v interface{}) (string, error) {
+	x, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	// round to two decimal places if there are more, before splitting the number up,
+	// so rounding can carry into the whole part
+	s := strconv.FormatFloat(math.Abs(x), 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 && len(s)-i > 3 {
+		s = strconv.FormatFloat(math.Abs(x), 'f', 2, 64)
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i:]
+	}
+	var out strings.Builder
+	// small negative numbers can round to zero, which shouldn't get a sign
+	if x < 0 && strings.Trim(s, "0.") != "" {
+		out.WriteByte('-')
+	}
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			out.WriteByte(',')
+		}
+		out.WriteRune(digit)
+	}
+	out.WriteString(frac)
+	return out.String(), nil
+}
+
+// Named time layouts that can be used in place of Go layout strings.
+var timeLayouts = map[string]string{
+	"rfc3339":  time.RFC3339,
+	"rfc1123":  time.RFC1123,
+	"date":     "2006-01-02",
+	"time":     "15:04:05",
+	"datetime": "2006-01-02 15:04:05",
+	"kitchen":  time.Kitchen,
+}
+
+// timeLayout resolves a named time layout.
+func timeLayout(layout string) string {
+	if named, ok := timeLayouts[layout]; ok {
+		return named
+	}
+	return layout
+}
+
+// markdownEscaper escapes Discord's markdown characters.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`, ">", `\>`,
+	"@everyone", "@\u200beveryone", "@here", "@\u200bhere",
+)
+
+// escapeMarkdown escapes a string so Discord shows it as-is,
+// also defusing @everyone and @here.
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// toList converts any slice or array to a []interface{}.
+func toList(list interface{}) ([]interface{}, error) {
+	if list == nil {
+		return nil, nil
+	}
+	if items, ok := list.([]interface{}); ok {
+		return items, nil
+	}
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%v is not a list", list)
+	}
+	items := make([]interface{}, value.Len())
+	for i := range items {
+		items[i] = value.Index(i).Interface()
+	}
+	return items, nil
+}
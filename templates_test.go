@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	data := map[string]interface{}{
+		"n":     1234567.891,
+		"title": "Hello, world",
+		"empty": "",
+		"list":  []interface{}{"b", "c", "a"},
+		"dict":  map[string]interface{}{"y": 2.0, "x": 1.0},
+	}
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		// Strings
+		{`{{upper "abc"}}`, "ABC"},
+		{`{{.title | truncate 5}}`, "Hell…"},
+		{`{{.title | truncate 50}}`, "Hello, world"},
+		{`{{"a-b-c" | replace "-" "+"}}`, "a+b+c"},
+		{`{{"  x  " | trim}}`, "x"},
+		{`{{"foo.txt" | trimsuffix ".txt"}}`, "foo"},
+		{`{{repeat 3 "ab"}}`, "ababab"},
+		{`{{json .title}}`, `"Hello, world"`},
+		{`{{path "a/b c"}}`, "a%2Fb%20c"},
+		{`{{query "a&b c"}}`, "a%26b+c"},
+		// Defaults
+		{`{{.empty | default "none"}}`, "none"},
+		{`{{.missing | default "none"}}`, "none"},
+		{`{{coalesce .empty .title}}`, "Hello, world"},
+		{`{{empty .list}}`, "false"},
+		// Math
+		{`{{add 1 "2"}}`, "3"},
+		{`{{div 7 2}}`, "3.5"},
+		{`{{mod 7 2}}`, "1"},
+		{`{{round 1 2.46}}`, "2.5"},
+		{`{{int "42.9"}}`, "42"},
+		{`{{max 3 4.5}}`, "4.5"},
+		// Number formatting
+		{`{{number .n}}`, "1,234,567.89"},
+		{`{{number 1000}}`, "1,000"},
+		{`{{number 1.5}}`, "1.5"},
+		{`{{number 1.999}}`, "2.00"},
+		{`{{number 999999.999}}`, "1,000,000.00"},
+		{`{{number -1234.5}}`, "-1,234.5"},
+		{`{{number -0.001}}`, "0.00"},
+		{`{{number 12}}`, "12"},
+		// Collections
+		{`{{join ", " .list}}`, "b, c, a"},
+		{`{{first .list}} {{last .list}}`, "b a"},
+		{`{{sort .list | join ""}}`, "abc"},
+		{`{{limit 2 .list | join ""}}`, "bc"},
+		{`{{keys .dict | join ""}}`, "xy"},
+		{`{{range seq 3}}{{.}}{{end}}`, "012"},
+		{`{{(dict "a" 1).a}}`, "1"},
+		{`{{list 1 2 | len}}`, "2"},
+		// Discord formatting
+		{`{{mention 123}}`, "<@123>"},
+		{`{{channel 123}}`, "<#123>"},
+		{`{{role 123}}`, "<@&123>"},
+		{`{{escape "*hi* @everyone"}}`, "\\*hi\\* @\u200beveryone"},
+		{"{{code \"a`b\"}}", "`a'b`"},
+		{`{{bold "x"}} {{italic "x"}} {{spoiler "x"}}`, "**x** *x* ||x||"},
+		{`{{quote "a\nb"}}`, "> a\n> b"},
+		// Time
+		{`{{unix 43200 | formattime "date"}}`, "1970-01-01"},
+		{`{{duration 90}}`, "1m30s"},
+		{`{{(parsetime "date" "2020-02-03").Day}}`, "3"},
+	}
+	for _, test := range tests {
+		tmpl, err := newTemplate("test", test.tmpl)
+		if err != nil {
+			t.Errorf("%s: %s", test.tmpl, err)
+			continue
+		}
+		got, err := executeTemplate(tmpl, data)
+		if err != nil {
+			t.Errorf("%s: %s", test.tmpl, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.tmpl, got, test.want)
+		}
+	}
+}
+
+func TestTemplateFuncErrors(t *testing.T) {
+	for _, text := range []string{
+		`{{div 1 0}}`,
+		`{{mod 1 0}}`,
+		`{{add "x" 1}}`,
+		`{{dict "a"}}`,
+		`{{random}}`,
+		`{{randint 2 1}}`,
+		`{{seq -1}}`,
+		`{{repeat 300000 "x"}}`,
+	} {
+		tmpl, err := newTemplate("test", text)
+		if err != nil {
+			t.Errorf("%s: %s", text, err)
+			continue
+		}
+		if _, err := executeTemplate(tmpl, nil); err == nil {
+			t.Errorf("%s: expected an error", text)
+		}
+	}
+}
+
+func TestTemplateOutputLimit(t *testing.T) {
+	tmpl, err := newTemplate("test", `{{range seq 1000}}{{repeat 1000 "x"}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = executeTemplate(tmpl, nil)
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("expected the output limit to be hit, got %v", err)
+	}
+}
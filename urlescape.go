@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"text/template"
+	"text/template/parse"
+)
+
+// Parts of a URL an endpoint template action can be in.
+const (
+	urlPartPath = iota
+	urlPartQuery
+	urlPartFragment
+)
+
+// urlEscapers are the functions escapeEndpointTemplate adds to actions,
+// by the part of the URL they're in. They aren't in templateFuncs,
+// so they're only available to endpoint templates.
+// Actions can output any value, so they format it like the template would first.
+var urlEscapers = template.FuncMap{
+	"_escapepath":     func(v interface{}) string { return url.PathEscape(fmt.Sprint(v)) },
+	"_escapequery":    func(v interface{}) string { return url.QueryEscape(fmt.Sprint(v)) },
+	"_escapefragment": func(v interface{}) string { return url.PathEscape(fmt.Sprint(v)) },
+}
+
+// urlEscaperNames are the escaper names by URL part.
+var urlEscaperNames = []string{
+	urlPartPath:     "_escapepath",
+	urlPartQuery:    "_escapequery",
+	urlPartFragment: "_escapefragment",
+}
+
+// urlEscaped are the functions whose output is already escaped (or, for raw, meant not to be),
+// so actions ending with them are left alone.
+var urlEscaped = map[string]bool{
+	"raw":   true,
+	"path":  true,
+	"query": true,
+}
+
+// escapeEndpointTemplate makes an endpoint template escape everything it outputs
+// for the part of the URL it ends up in: path segments are path-escaped and query
+// and fragment values are query- and path-escaped respectively.
+// Like html/template, this works by adding an escaper to the end of every action
+// that outputs something, so {{.Named.user}} becomes {{.Named.user | _escapepath}}.
+// This covers variables and templates called with {{template}} too, since their
+// actions are escaped wherever their values come from.
+// Actions already ending with path, query or raw are left as they are.
+func escapeEndpointTemplate(tmpl *template.Template) error {
+	tmpl.Funcs(urlEscapers)
+	e := endpointEscaper{
+		tmpl:   tmpl,
+		called: make(map[string]urlSpan),
+	}
+	return e.walk(tmpl.Tree.Root)
+}
+
+// urlSpan is the part of the URL a called template starts in, and the part it leaves off in.
+type urlSpan struct {
+	start, end int
+}
+
+// endpointEscaper tracks which part of the URL an endpoint template is in while walking it.
+type endpointEscaper struct {
+	tmpl *template.Template
+	part int
+	// Templates that have been escaped, by name.
+	called map[string]urlSpan
+}
+
+// walk adds escapers to the actions in a list of nodes.
+func (e *endpointEscaper) walk(list *parse.ListNode) error {
+	if list == nil {
+		return nil
+	}
+	for _, node := range list.Nodes {
+		var err error
+		switch node := node.(type) {
+		case *parse.TextNode:
+			e.text(node.Text)
+		case *parse.ActionNode:
+			e.action(node.Pipe)
+		case *parse.IfNode:
+			err = e.branches(node.List, node.ElseList)
+		case *parse.RangeNode:
+			err = e.branches(node.List, node.ElseList)
+		case *parse.WithNode:
+			err = e.branches(node.List, node.ElseList)
+		case *parse.TemplateNode:
+			err = e.call(node.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// branches walks the lists of an if, range or with.
+func (e *endpointEscaper) branches(list, elseList *parse.ListNode) error {
+	err := e.walk(list)
+	if err != nil {
+		return err
+	}
+	return e.walk(elseList)
+}
+
+// call escapes a template called with {{template}}. Since the escapers are added to the
+// template itself, it has to start in the same part of the URL everywhere it's used.
+func (e *endpointEscaper) call(name string) error {
+	if span, ok := e.called[name]; ok {
+		if span.start != e.part {
+			return errors.New("template " + name + " is used in more than one part of the URL")
+		}
+		e.part = span.end
+		return nil
+	}
+	called := e.tmpl.Lookup(name)
+	if called == nil || called.Tree == nil {
+		// this fails when the template is executed
+		return nil
+	}
+	// note it before walking it, in case it calls itself
+	e.called[name] = urlSpan{start: e.part, end: e.part}
+	start := e.part
+	err := e.walk(called.Tree.Root)
+	if err != nil {
+		return err
+	}
+	e.called[name] = urlSpan{start: start, end: e.part}
+	return nil
+}
+
+// text moves to the next part of the URL if text starts it.
+func (e *endpointEscaper) text(text []byte) {
+	for _, c := range text {
+		switch {
+		case c == '?' && e.part == urlPartPath:
+			e.part = urlPartQuery
+		case c == '#':
+			e.part = urlPartFragment
+		}
+	}
+}
+
+// action adds an escaper to an action that outputs something.
+func (e *endpointEscaper) action(pipe *parse.PipeNode) {
+	// actions that set variables don't output anything
+	if len(pipe.Decl) > 0 || len(pipe.Cmds) == 0 {
+		return
+	}
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	if ident, ok := last.Args[0].(*parse.IdentifierNode); ok && urlEscaped[ident.Ident] {
+		return
+	}
+	escaper := parse.NewIdentifier(urlEscaperNames[e.part]).SetTree(nil).SetPos(pipe.Pos)
+	pipe.Cmds = append(pipe.Cmds, &parse.CommandNode{
+		NodeType: parse.NodeCommand,
+		Pos:      pipe.Pos,
+		Args:     []parse.Node{escaper},
+	})
+}
@@ -20,6 +20,28 @@ type BotConfiguration struct {
 	Status string `json:"status"`
 	// List of commands to try and create.
 	Commands []BaseCommand `json:"commands"`
+	// Optional directory to cache HTTP responses in, so the cache survives restarts.
+	// If unset, responses are cached in memory.
+	CacheDir string `json:"cacheDir"`
+	// Maximum size of the HTTP cache in bytes. Least recently used responses are
+	// dropped once it's full. Defaults to 64MB.
+	CacheSize int64 `json:"cacheSize"`
+	// File to keep state that has to survive restarts in, like what watchers have announced.
+	// Defaults to valerius-state.json in the working directory.
+	StateFile string `json:"stateFile"`
+	// Address for the webhook server to listen on, e.g. ":8080".
+	// Only needed if there are webhook commands.
+	WebhookListen string `json:"webhookListen"`
+	// Auth profiles that REST commands can authenticate with, by name.
+	AuthProfiles map[string]AuthProfileConfig `json:"authProfiles"`
+	// HTTP profiles (proxies, custom CAs and client certificates) commands can use, by name.
+	HTTPProfiles map[string]HTTPProfileConfig `json:"httpProfiles"`
+	// Name of the HTTP profile to use for outbound HTTP that doesn't set one.
+	HTTPProfile string `json:"httpProfile"`
+	// Webhooks to send the bot's events to, like commands firing and failing.
+	EventHooks []EventHookConfig `json:"eventHooks"`
+	// Restrictions on the outbound HTTP requests commands can make.
+	Network NetworkPolicyConfig `json:"network"`
 }
 
 var (
@@ -29,7 +51,8 @@ var (
 	configPath = flag.String("conf", "valerius.json", "Path to the config file.")
 )
 
-func init() {
+// setup parses flags, sets up logging and reads the bot config.
+func setup() {
 	// parse flags
 	flag.Parse()
 	// setup log
@@ -43,13 +66,20 @@ func init() {
 		// set up the output and formatter
 		log.SetOutput(io.MultiWriter(os.Stdout, logfile))
 	}
-	// have to set err here so config goes in as a global var, 'cuz Go
-	// (this is probably the wrong way to do it, though)
-	var err error
-	config, err = ReadBotConfig(*configPath)
+	newconfig, err := ReadBotConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	useConfig(newconfig)
+}
+
+// useConfig makes a bot config the current one. Commands read it while they're built,
+// but the settings used after that (by requests, watchers and so on) are passed on here,
+// so nothing running in the background reads the config while a reload replaces it.
+func useConfig(newconfig BotConfiguration) {
+	config = newconfig
+	setAuthProfiles(newconfig.AuthProfiles)
+	botState.setPath(newconfig.StateFile)
 }
 
 // Initialize the bot.
@@ -57,6 +87,12 @@ func initBot() (bot *discordgo.Session, err error) {
 	log.Info("Bot initializing")
 	// start the bot session
 	bot, err = discordgo.New("Bot " + config.BotToken)
+	if err != nil {
+		return
+	}
+	// we need message content to test commands against, and guild events so the state
+	// cache knows channel and guild names (DMs are ignored, so we don't ask for those)
+	bot.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentMessageContent
 	// get the current bot user (to figure out who we are)
 	user, err := bot.User("@me")
 	if err != nil {
@@ -79,34 +115,52 @@ func ReadBotConfig(path string) (config BotConfiguration, err error) {
 	if err != nil {
 		return config, errors.New("Unable to read config file: " + err.Error())
 	}
+	// validate the network policy
+	err = config.Network.parse()
+	if err != nil {
+		return config, errors.New("Invalid network policy: " + err.Error())
+	}
 	return config, nil
 }
 
 func main() {
+	setup()
 	// initialize the bot
 	bot, err := initBot()
 	if err != nil {
 		log.Fatal("Failed to initialize bot: ", err)
 	}
 	defer bot.Close()
+	// set up event hooks
+	hooks, err := newEventHooks(config.EventHooks)
+	if err != nil {
+		log.Fatal(err)
+	}
 	// instantiate the handler
 	handler, err = NewHandler(bot, config.Commands)
 	if err != nil {
 		log.Fatal(err)
 	}
+	events.setHooks(hooks)
 	// open the bot to be used
 	bot.Open()
 	// set our status
 	if len(config.Status) > 0 {
-		err = bot.UpdateStatus(0, config.Status)
+		err = bot.UpdateGameStatus(0, config.Status)
 		if err != nil {
 			log.Error("Error setting status:", err)
 		}
 	}
+	events.emit(Event{Type: eventStartup, Commands: len(handler.commands)})
 	// wait for OS interrupt (ctrl-c or a kill or something)
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, os.Kill)
 	<-sig
 	// close the bot websocket and exit the program
 	log.Info("Interrupt signal sent, shutting down...")
+	// stop background commands (watchers, feeds, webhooks and schedules) before the session
+	// closes, so anything they're in the middle of can finish and save its state
+	handler.DestroySelf()
+	events.emit(Event{Type: eventShutdown})
+	events.drain(eventDrainTimeout)
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"  // for running the bot
+	log "github.com/sirupsen/logrus" // logging suite
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Ways of validating inbound webhooks.
+const (
+	// GitHub style: an HMAC-SHA256 of the body in X-Hub-Signature-256, as "sha256=<hex>".
+	webhookGitHub = "github"
+	// GitLab style: the secret itself in X-Gitlab-Token.
+	webhookGitLab = "gitlab"
+	// A hex HMAC-SHA256 of the body in a configurable header.
+	webhookHMAC = "hmac"
+	// The secret itself in a configurable header.
+	webhookToken = "token"
+)
+
+// maxWebhookBody is the largest webhook payload accepted.
+const maxWebhookBody = 1 << 20
+
+// WebhookCommand receives webhooks on a path of the bot's webhook server,
+// and posts a templated message about them to channels.
+// It isn't triggered by messages.
+type WebhookCommand struct {
+	BaseCommand
+	WebhookConfig
+	secret   string
+	template *template.Template
+	embed    *embedTemplate
+	bot      *discordgo.Session
+}
+
+// WebhookConfig is the configuration for the WebhookCommand.
+// The bot config's webhookListen must be set for the server to run.
+type WebhookConfig struct {
+	// Path to receive webhooks on, e.g. "/hooks/ci".
+	Path string `json:"path"`
+	// How to validate webhooks: "github", "gitlab", "hmac" or "token".
+	Validation string `json:"validation"`
+	// Shared secret. Can be read from the environment with "env:NAME" or a file with "file:/path".
+	Secret string `json:"secret"`
+	// Header the signature or token is in, for "hmac" and "token" validation.
+	// Defaults to X-Signature for "hmac" and X-Webhook-Token for "token".
+	Header string `json:"header"`
+	// Prefix before the signature, for "hmac" validation, e.g. "sha256=".
+	Prefix string `json:"prefix"`
+	// If set, only these events are posted. The event is read from X-GitHub-Event,
+	// X-Gitlab-Event, or the header in eventheader.
+	Events []string `json:"events"`
+	// Header to read the event from, for other senders.
+	EventHeader string `json:"eventheader"`
+	// IDs of the channels to post in.
+	Channels []string `json:"channels"`
+	// Template for the message, executed with a WebhookContext.
+	// If it renders empty (and there's no embed), nothing is posted.
+	Response string `json:"response"`
+	// Rich embed to post, rendered with the WebhookContext like the response.
+	Embed *EmbedConfig `json:"embed"`
+}
+
+// WebhookContext is the data webhook messages are rendered with.
+type WebhookContext struct {
+	// The decoded JSON payload.
+	Payload interface{}
+	// The event, if the sender says what it is.
+	Event string
+	// Request headers, with the first value of each.
+	Headers map[string]string
+	// Query parameters, with the first value of each.
+	Query map[string]string
+	// Time the webhook was received.
+	Now time.Time
+}
+
+// NewWebhookCommand generates a new WebhookCommand.
+func NewWebhookCommand(config BaseCommand) (command *WebhookCommand, err error) {
+	var options WebhookConfig
+	err = json.Unmarshal(config.Options, &options)
+	if err != nil {
+		return nil, err
+	}
+	command = &WebhookCommand{
+		BaseCommand:   config,
+		WebhookConfig: options,
+	}
+	if !strings.HasPrefix(options.Path, "/") {
+		return nil, errors.New("path must start with /")
+	}
+	switch options.Validation {
+	case webhookGitHub, webhookGitLab:
+	case webhookHMAC:
+		if len(options.Header) == 0 {
+			command.Header = "X-Signature"
+		}
+	case webhookToken:
+		if len(options.Header) == 0 {
+			command.Header = "X-Webhook-Token"
+		}
+	default:
+		return nil, errors.New("Invalid validation " + options.Validation + "; webhooks must be validated")
+	}
+	command.secret, err = resolveSecret(options.Secret)
+	if err != nil {
+		return nil, errors.New("Could not read secret: " + err.Error())
+	}
+	if len(command.secret) == 0 {
+		return nil, errors.New("webhooks need a secret")
+	}
+	if len(options.Channels) == 0 {
+		return nil, errors.New("webhooks need at least one channel")
+	}
+	if len(options.Response) == 0 && options.Embed == nil {
+		return nil, errors.New("webhooks need a response or an embed")
+	}
+	if len(options.Response) > 0 {
+		command.template, err = newTemplate(config.Name, options.Response)
+		if err != nil {
+			return nil, errors.New("Failed to compile template: " + err.Error())
+		}
+	}
+	if options.Embed != nil {
+		command.embed, err = newEmbedTemplate(config.Name, *options.Embed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return command, nil
+}
+
+// Test always fails, since webhooks aren't triggered by messages.
+func (w *WebhookCommand) Test(bot *discordgo.Session, evt *discordgo.MessageCreate) bool {
+	return false
+}
+
+// Run does nothing, since webhooks aren't triggered by messages.
+func (w *WebhookCommand) Run(bot *discordgo.Session, evt *discordgo.MessageCreate) error {
+	return nil
+}
+
+// start adds the webhook's route to the server.
+// NewHandler has already made sure the server is listening.
+func (w *WebhookCommand) start(bot *discordgo.Session) {
+	w.bot = bot
+	webhooks.register(w)
+}
+
+// stop removes the webhook's route from the server.
+func (w *WebhookCommand) stop() {
+	webhooks.unregister(w)
+}
+
+// validate checks a webhook's signature or token.
+func (w *WebhookCommand) validate(r *http.Request, body []byte) bool {
+	switch w.Validation {
+	case webhookGitHub:
+		return checkHMAC(w.secret, body, r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	case webhookGitLab:
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(w.secret)) == 1
+	case webhookHMAC:
+		return checkHMAC(w.secret, body, r.Header.Get(w.Header), w.Prefix)
+	case webhookToken:
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get(w.Header)), []byte(w.secret)) == 1
+	}
+	return false
+}
+
+// checkHMAC checks a hex HMAC-SHA256 signature of a body.
+func checkHMAC(secret string, body []byte, signature, prefix string) bool {
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// event finds the event a webhook is for.
+func (w *WebhookCommand) event(r *http.Request) string {
+	if len(w.EventHeader) > 0 {
+		return r.Header.Get(w.EventHeader)
+	}
+	if event := r.Header.Get("X-GitHub-Event"); len(event) > 0 {
+		return event
+	}
+	return r.Header.Get("X-Gitlab-Event")
+}
+
+// ServeHTTP handles a webhook.
+func (w *WebhookCommand) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	fields := log.Fields{
+		"command": w.Name,
+		"path":    r.URL.Path,
+		"remote":  r.RemoteAddr,
+	}
+	if r.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(rw, "could not read body", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !w.validate(r, body) {
+		fields["security"] = true
+		log.WithFields(fields).Warn("Rejected webhook with invalid signature")
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	ctx := WebhookContext{
+		Event:   w.event(r),
+		Headers: make(map[string]string),
+		Query:   make(map[string]string),
+		Now:     time.Now(),
+	}
+	fields["event"] = ctx.Event
+	if len(w.Events) > 0 && !listContains(w.Events, ctx.Event) {
+		log.WithFields(fields).Debug("Ignored webhook event")
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	err = json.Unmarshal(body, &ctx.Payload)
+	if err != nil {
+		http.Error(rw, "payload is not JSON", http.StatusBadRequest)
+		return
+	}
+	for key := range r.Header {
+		ctx.Headers[key] = r.Header.Get(key)
+	}
+	for key, values := range r.URL.Query() {
+		ctx.Query[key] = values[0]
+	}
+	log.WithFields(fields).Info("Webhook received")
+	err = announce(w.bot, w.Channels, w.template, w.embed, ctx)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err).Error("Webhook failed")
+		http.Error(rw, "could not post webhook", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// webhookServer is the HTTP server webhooks are received on.
+// It's shared by every webhook command, and kept running across reloads.
+type webhookServer struct {
+	mu     sync.Mutex
+	server *http.Server
+	addr   string
+	routes map[string]*WebhookCommand
+}
+
+// webhooks is the bot's webhook server.
+var webhooks = &webhookServer{
+	routes: make(map[string]*WebhookCommand),
+}
+
+// listen starts the server on an address, if it isn't already listening there.
+// If it was listening somewhere else, it only moves once the new address is bound,
+// so a config with an address that can't be used fails without taking webhooks down.
+func (s *webhookServer) listen(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server != nil && s.addr == addr {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.shutdown()
+	s.addr = addr
+	s.server = &http.Server{
+		Handler:      s,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	go func(server *http.Server) {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithField("error", err).Error("Webhook server failed")
+		}
+	}(s.server)
+	log.WithField("address", s.addr).Info("Webhook server listening")
+	return nil
+}
+
+// register adds a webhook's route.
+func (s *webhookServer) register(w *WebhookCommand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a reloaded command replaces the old one's route
+	// (NewHandler makes sure commands in the same config don't share one)
+	s.routes[w.Path] = w
+}
+
+// unregister removes a webhook's route, unless another command has taken it over,
+// and stops the server if no routes are left.
+func (s *webhookServer) unregister(w *WebhookCommand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.routes[w.Path] == w {
+		delete(s.routes, w.Path)
+	}
+	if len(s.routes) == 0 {
+		s.shutdown()
+	}
+}
+
+// shutdown stops the server, if it's running. The caller must hold s.mu.
+func (s *webhookServer) shutdown() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+	s.server = nil
+	log.WithField("address", s.addr).Info("Webhook server stopped")
+}
+
+// ServeHTTP routes a request to its webhook.
+func (s *webhookServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	w, ok := s.routes[r.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	w.ServeHTTP(rw, r)
+}